@@ -0,0 +1,146 @@
+package main
+
+import (
+	"cmp"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+// workload identifies a deployment of a project.
+type workload struct {
+	ProjectID int64
+	Name      string
+}
+
+// workloadSeries is the history of every pod or service of a workload.
+type workloadSeries struct {
+	workload
+	Kind   string
+	Series []*prom.PodSeries
+}
+
+// First returns the time of the earliest point of w.
+func (w *workloadSeries) First() time.Time {
+	var r time.Time
+	for _, s := range w.Series {
+		if len(s.Points) > 0 && (r.IsZero() || s.Points[0].Time.Before(r)) {
+			r = s.Points[0].Time
+		}
+	}
+	return r
+}
+
+// Sum returns the sum of all series of w at each point in time, sorted by time.
+func (w *workloadSeries) Sum() []prom.Point {
+	m := make(map[time.Time]float64)
+	for _, s := range w.Series {
+		for _, p := range s.Points {
+			m[p.Time] += p.Value
+		}
+	}
+
+	ps := make([]prom.Point, 0, len(m))
+	for _, t := range slices.SortedFunc(maps.Keys(m), time.Time.Compare) {
+		ps = append(ps, prom.Point{Time: t, Value: m[t]})
+	}
+	return ps
+}
+
+// NameKeys returns the workloads of the series of w parsed from their pod
+// names only, the naming source of service series, whatever the labels say.
+func (w *workloadSeries) NameKeys() []workload {
+	var ks []workload
+	for _, s := range w.Series {
+		a, ok := parsePodName(s.Pod)
+		if !ok {
+			continue
+		}
+		k := workload{ProjectID: a.ProjectID, Name: a.Name}
+		if !slices.Contains(ks, k) {
+			ks = append(ks, k)
+		}
+	}
+	return ks
+}
+
+// groupWorkloads groups series by the workload they are attributed to.
+// Unattributed series and series of inactive projects are skipped,
+// they are already reported by the collector.
+func groupWorkloads(ss []*prom.PodSeries, projects map[int64]struct{}) map[workload]*workloadSeries {
+	m := make(map[workload]*workloadSeries)
+	for _, s := range ss {
+		a, reason := attributePod(&s.PodVector)
+		if reason != "" {
+			continue
+		}
+		if projects != nil {
+			if _, ok := projects[a.ProjectID]; !ok {
+				continue
+			}
+		}
+
+		k := workload{ProjectID: a.ProjectID, Name: a.Name}
+		x := m[k]
+		if x == nil {
+			x = &workloadSeries{workload: k, Kind: a.Kind}
+			m[k] = x
+		}
+		x.Series = append(x.Series, s)
+	}
+	return m
+}
+
+// sortedWorkloads returns the keys of m sorted by project then name.
+func sortedWorkloads[T any](m map[workload]T) []workload {
+	return slices.SortedFunc(maps.Keys(m), func(a, b workload) int {
+		return cmp.Or(cmp.Compare(a.ProjectID, b.ProjectID), cmp.Compare(a.Name, b.Name))
+	})
+}
+
+// Values returns every point value of every series of w.
+func (w *workloadSeries) Values() []float64 {
+	var vs []float64
+	for _, s := range w.Series {
+		for _, p := range s.Points {
+			vs = append(vs, p.Value)
+		}
+	}
+	return vs
+}
+
+// Latest returns the highest last value of the series of w,
+// the current value of its newest pods.
+func (w *workloadSeries) Latest() float64 {
+	var (
+		r float64
+		t time.Time
+	)
+	for _, s := range w.Series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		p := s.Points[len(s.Points)-1]
+		switch {
+		case p.Time.After(t):
+			r, t = p.Value, p.Time
+		case p.Time.Equal(t):
+			r = max(r, p.Value)
+		}
+	}
+	return r
+}
+
+// quantile returns the q quantile of vs using the nearest rank,
+// or 0 if vs is empty. vs is sorted in place.
+func quantile(vs []float64, q float64) float64 {
+	if len(vs) == 0 {
+		return 0
+	}
+	slices.Sort(vs)
+	i := int(math.Ceil(q*float64(len(vs)))) - 1
+	return vs[min(max(i, 0), len(vs)-1)]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+func TestQuantile(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Values []float64
+		Q      float64
+		Want   float64
+	}{
+		{"empty", nil, 0.95, 0},
+		{"one", []float64{3}, 0.95, 3},
+		{"unsorted", []float64{5, 1, 4, 2, 3}, 0.5, 3},
+		{"nearest rank", []float64{1, 2, 3, 4}, 0.5, 2},
+		{"p95", []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, 0.95, 19},
+		{"max", []float64{1, 3, 2}, 1, 3},
+		{"min", []float64{2, 1, 3}, 0, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			if got := quantile(c.Values, c.Q); got != c.Want {
+				t.Errorf("quantile(%v, %v) = %v, want %v", c.Values, c.Q, got, c.Want)
+			}
+		})
+	}
+}
+
+func TestWorkloadSeriesLatest(t *testing.T) {
+	t0 := time.Unix(1800000000, 0)
+	series := func(ps ...prom.Point) *prom.PodSeries {
+		return &prom.PodSeries{Series: prom.Series{Points: ps}}
+	}
+	at := func(m int, v float64) prom.Point {
+		return prom.Point{Time: t0.Add(time.Duration(m) * time.Minute), Value: v}
+	}
+
+	cases := []struct {
+		Name   string
+		Series []*prom.PodSeries
+		Want   float64
+	}{
+		{"empty", nil, 0},
+		{"no points", []*prom.PodSeries{series()}, 0},
+		{"last point", []*prom.PodSeries{series(at(0, 2), at(1, 1))}, 1},
+		// a rollout replaced the old pod, its last value is older
+		{"newest pod", []*prom.PodSeries{series(at(0, 4), at(1, 4)), series(at(1, 2), at(2, 2))}, 2},
+		{"highest of newest", []*prom.PodSeries{series(at(0, 1), at(2, 1)), series(at(2, 3)), series(at(1, 9))}, 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			w := workloadSeries{Series: c.Series}
+			if got := w.Latest(); got != c.Want {
+				t.Errorf("got %v, want %v", got, c.Want)
+			}
+		})
+	}
+}
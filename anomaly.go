@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deploys-app/api"
+)
+
+// Anomaly threshold models, the score of a daily value is compared
+// against the threshold.
+const (
+	// anomalyModelRatio scores a value by its ratio to the baseline mean.
+	anomalyModelRatio = "ratio"
+
+	// anomalyModelZScore scores a value by its standard deviations
+	// above the baseline mean.
+	anomalyModelZScore = "zscore"
+)
+
+// anomalyModelBudget is the model of alerts of a value above the absolute
+// budget of its project and resource, checked whatever the baseline model.
+const anomalyModelBudget = "budget"
+
+// minAnomalyBaseline is the number of baseline days with usage
+// required to score a value.
+const minAnomalyBaseline = 3
+
+const anomalyDateLayout = "2006-01-02"
+
+func validAnomalyModel(model string) error {
+	switch model {
+	case anomalyModelRatio, anomalyModelZScore:
+		return nil
+	default:
+		return fmt.Errorf("unknown anomaly model %q", model)
+	}
+}
+
+func mean(vs []float64) float64 {
+	var r float64
+	for _, v := range vs {
+		r += v
+	}
+	return r / float64(len(vs))
+}
+
+// anomalyScore returns the score of value against the baseline values,
+// false if the baseline can not score it.
+func anomalyScore(model string, value float64, baseline []float64) (float64, bool) {
+	if len(baseline) < minAnomalyBaseline {
+		return 0, false
+	}
+
+	mean := mean(baseline)
+
+	switch model {
+	case anomalyModelRatio:
+		if mean <= 0 {
+			return 0, false
+		}
+		return value / mean, true
+	case anomalyModelZScore:
+		var variance float64
+		for _, v := range baseline {
+			variance += (v - mean) * (v - mean)
+		}
+		sd := math.Sqrt(variance / float64(len(baseline)))
+		if sd <= 0 {
+			return 0, false
+		}
+		return (value - mean) / sd, true
+	}
+	return 0, false
+}
+
+// anomalyDetector alerts when a daily project usage jumps above
+// its trailing baseline.
+type anomalyDetector struct {
+	WebhookURL   string
+	HTTPClient   *http.Client
+	Model        string
+	Threshold    float64
+	BaselineDays int
+
+	// Resources are checked against their baseline, memory is
+	// the memory resources of the memory billing policy of each project.
+	Resources []string
+
+	// Budgets are the absolute daily limits per project and resource.
+	Budgets map[int64]map[string]float64
+
+	mu      sync.Mutex
+	history map[int64]map[string]map[string]float64 // project, date, resource
+	alerted map[string]string                       // project/resource/date to date
+}
+
+// anomalyAlert is the webhook payload of an anomaly.
+type anomalyAlert struct {
+	Location  string  `json:"location"`
+	ProjectID int64   `json:"projectId"`
+	Date      string  `json:"date"`
+	Resource  string  `json:"resource"`
+	Value     float64 `json:"value"`
+	Baseline  float64 `json:"baseline"` // mean of the baseline days, 0 for budget
+	Model     string  `json:"model"`
+	Score     float64 `json:"score"`     // the value for budget
+	Threshold float64 `json:"threshold"` // the budget for budget
+}
+
+func (d *anomalyDetector) day(projectID int64, date string) (map[string]float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	m, ok := d.history[projectID][date]
+	return m, ok
+}
+
+func (d *anomalyDetector) setDay(projectID int64, date string, values map[string]float64, oldest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.history == nil {
+		d.history = make(map[int64]map[string]map[string]float64)
+	}
+	days := d.history[projectID]
+	if days == nil {
+		days = make(map[string]map[string]float64)
+		d.history[projectID] = days
+	}
+	days[date] = values
+
+	// dates sort as strings
+	for k := range days {
+		if k < oldest {
+			delete(days, k)
+		}
+	}
+}
+
+// markAlerted records key of date, reports false if it was already alerted.
+// Keys of dates before oldest are forgotten.
+func (d *anomalyDetector) markAlerted(key, date, oldest string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.alerted == nil {
+		d.alerted = make(map[string]string)
+	}
+	for k, v := range d.alerted {
+		if v < oldest {
+			delete(d.alerted, k)
+		}
+	}
+	if _, ok := d.alerted[key]; ok {
+		return false
+	}
+	d.alerted[key] = date
+	return true
+}
+
+func (d *anomalyDetector) unmarkAlerted(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.alerted, key)
+}
+
+// values returns the values of resources named in names,
+// or of all resources if names is nil.
+func (d *anomalyDetector) values(resources []*api.CollectorProjectUsageResource, names []string) map[string]float64 {
+	m := make(map[string]float64)
+	for _, r := range resources {
+		if names != nil && !slices.Contains(names, r.Name) {
+			continue
+		}
+		v, err := strconv.ParseFloat(r.Value, 64)
+		if err != nil {
+			continue
+		}
+		m[r.Name] = v
+	}
+	return m
+}
+
+func (d *anomalyDetector) send(ctx context.Context, alert *anomalyAlert) error {
+	b, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.WebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := d.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// anomalyResources returns the detector resources of p, memory is
+// the memory resources of the memory billing policy of p.
+func (w *Worker) anomalyResources(p *api.CollectorProject) []string {
+	var names []string
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	for _, name := range w.Anomaly.Resources {
+		if name != "memory" {
+			add(name)
+			continue
+		}
+		for _, s := range w.memorySummaries(p) {
+			add(s.Name)
+		}
+	}
+	return names
+}
+
+// baselineDay returns the values of resources names of p at day,
+// computed once and kept for later baselines.
+func (w *Worker) baselineDay(ctx context.Context, p *api.CollectorProject, day time.Time, names []string, oldest string) (map[string]float64, error) {
+	d := w.Anomaly
+	date := day.Format(anomalyDateLayout)
+	if m, ok := d.day(p.ID, date); ok {
+		return m, nil
+	}
+
+	m := make(map[string]float64)
+	for _, s := range w.projectSummaries(p) {
+		if !slices.Contains(names, s.Name) {
+			continue
+		}
+		v, err := s.F(ctx, p.ID, day, day.AddDate(0, 0, 1))
+		if err != nil {
+			return nil, err
+		}
+		m[s.Name] = v
+	}
+	d.setDay(p.ID, date, m, oldest)
+	return m, nil
+}
+
+// checkAnomalies compares the finalized usage resources of p at day
+// against the budgets of p and the baseline of the days before it,
+// and alerts each anomalous resource once.
+// Baseline days before the first usage of a resource, e.g. before
+// the project was created, are not part of its baseline.
+func (w *Worker) checkAnomalies(ctx context.Context, p *api.CollectorProject, day time.Time, resources []*api.CollectorProjectUsageResource) {
+	d := w.Anomaly
+	first := day.AddDate(0, 0, -d.BaselineDays)
+	oldest := first.Format(anomalyDateLayout)
+	date := day.Format(anomalyDateLayout)
+	names := w.anomalyResources(p)
+
+	all := d.values(resources, nil)
+	for _, name := range slices.Sorted(maps.Keys(d.Budgets[p.ID])) {
+		budget := d.Budgets[p.ID][name]
+		value, ok := all[name]
+		if !ok || value <= budget {
+			continue
+		}
+		w.alertAnomaly(ctx, oldest, &anomalyAlert{
+			Location:  w.Location,
+			ProjectID: p.ID,
+			Date:      date,
+			Resource:  name,
+			Value:     value,
+			Model:     anomalyModelBudget,
+			Score:     value,
+			Threshold: budget,
+		})
+	}
+
+	values := d.values(resources, names)
+	d.setDay(p.ID, date, values, oldest)
+
+	baseline := make(map[string][]float64)
+	for t := first; t.Before(day); t = t.AddDate(0, 0, 1) {
+		m, err := w.baselineDay(ctx, p, t, names, oldest)
+		if err != nil {
+			slog.Error("collector: anomaly baseline error", "project", p.ID, "date", t.Format(anomalyDateLayout), "error", err)
+			return
+		}
+		for name, v := range m {
+			if v == 0 && len(baseline[name]) == 0 {
+				continue
+			}
+			baseline[name] = append(baseline[name], v)
+		}
+	}
+
+	for _, name := range names {
+		value, ok := values[name]
+		if !ok {
+			continue
+		}
+		score, ok := anomalyScore(d.Model, value, baseline[name])
+		if !ok || score < d.Threshold {
+			continue
+		}
+		w.alertAnomaly(ctx, oldest, &anomalyAlert{
+			Location:  w.Location,
+			ProjectID: p.ID,
+			Date:      date,
+			Resource:  name,
+			Value:     value,
+			Baseline:  mean(baseline[name]),
+			Model:     d.Model,
+			Score:     score,
+			Threshold: d.Threshold,
+		})
+	}
+}
+
+// alertAnomaly sends alert once per project, resource, model and date.
+// Alerts that fail to send are retried on the next check.
+func (w *Worker) alertAnomaly(ctx context.Context, oldest string, alert *anomalyAlert) {
+	d := w.Anomaly
+	key := strconv.FormatInt(alert.ProjectID, 10) + "/" + alert.Resource + "/" + alert.Model + "/" + alert.Date
+	if !d.markAlerted(key, alert.Date, oldest) {
+		return
+	}
+
+	slog.Warn("collector: usage anomaly", "project", alert.ProjectID, "date", alert.Date, "resource", alert.Resource, "model", alert.Model, "value", alert.Value, "baseline", alert.Baseline, "score", alert.Score)
+
+	err := d.send(ctx, alert)
+	if err != nil {
+		d.unmarkAlerted(key)
+		slog.Error("collector: send anomaly alert error", "project", alert.ProjectID, "resource", alert.Resource, "error", err)
+	}
+}
+
+// parseBudgets parses "<project id>/<resource>=<limit>" pairs separated by comma.
+func parseBudgets(s string) (map[int64]map[string]float64, error) {
+	m := make(map[int64]map[string]float64)
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q", kv)
+		}
+		project, resource, ok := strings.Cut(strings.TrimSpace(k), "/")
+		if !ok || resource == "" {
+			return nil, fmt.Errorf("invalid budget key %q", k)
+		}
+		id, err := strconv.ParseInt(project, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project id %q", project)
+		}
+		limit, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid budget %q", v)
+		}
+		if m[id] == nil {
+			m[id] = make(map[string]float64)
+		}
+		m[id][resource] = limit
+	}
+	return m, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deploys-app/api"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+func TestAnomalyScore(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Model    string
+		Value    float64
+		Baseline []float64
+		Score    float64
+		OK       bool
+	}{
+		{"ratio", anomalyModelRatio, 300, []float64{100, 100, 100}, 3, true},
+		{"ratio below", anomalyModelRatio, 50, []float64{100, 100, 100}, 0.5, true},
+		{"ratio zero baseline", anomalyModelRatio, 300, []float64{0, 0, 0}, 0, false},
+		{"zscore", anomalyModelZScore, 20, []float64{9, 10, 11}, 10 / math.Sqrt(2.0/3), true},
+		{"zscore flat baseline", anomalyModelZScore, 20, []float64{10, 10, 10}, 0, false},
+		{"min baseline", anomalyModelRatio, 300, []float64{100, 100}, 0, false},
+		{"empty baseline", anomalyModelZScore, 300, nil, 0, false},
+		{"unknown model", "x", 300, []float64{100, 100, 100}, 0, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			score, ok := anomalyScore(c.Model, c.Value, c.Baseline)
+			if ok != c.OK {
+				t.Fatalf("ok = %v, want %v", ok, c.OK)
+			}
+			if math.Abs(score-c.Score) > 1e-9 {
+				t.Errorf("score = %v, want %v", score, c.Score)
+			}
+		})
+	}
+}
+
+func TestAnomalyMarkAlerted(t *testing.T) {
+	var d anomalyDetector
+
+	if !d.markAlerted("1/egress/ratio/2026-10-17", "2026-10-17", "2026-10-10") {
+		t.Fatal("first alert not allowed")
+	}
+	if d.markAlerted("1/egress/ratio/2026-10-17", "2026-10-17", "2026-10-10") {
+		t.Fatal("duplicate alert allowed")
+	}
+	if !d.markAlerted("1/egress/ratio/2026-10-18", "2026-10-18", "2026-10-11") {
+		t.Fatal("alert of next day not allowed")
+	}
+
+	d.unmarkAlerted("1/egress/ratio/2026-10-18")
+	if !d.markAlerted("1/egress/ratio/2026-10-18", "2026-10-18", "2026-10-11") {
+		t.Fatal("unmarked alert not allowed")
+	}
+
+	// keys older than the baseline are forgotten
+	d.markAlerted("2/egress/ratio/2026-10-25", "2026-10-25", "2026-10-18")
+	if _, ok := d.alerted["1/egress/ratio/2026-10-17"]; ok {
+		t.Error("old key kept")
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	m, err := parseBudgets("12/egress=1e12, 12/cpu_usage=86400,7/egress=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m[12]["egress"] != 1e12 || m[12]["cpu_usage"] != 86400 || m[7]["egress"] != 5 {
+		t.Errorf("got %v", m)
+	}
+
+	for _, s := range []string{"12=1", "x/egress=1", "12/egress=x", "12/egress=-1", "12/=1"} {
+		if _, err := parseBudgets(s); err == nil {
+			t.Errorf("parseBudgets(%q) not error", s)
+		}
+	}
+}
+
+// webhook is a local stand-in of the alert webhook.
+type webhook struct {
+	mu     sync.Mutex
+	fail   int // requests left to fail
+	alerts []anomalyAlert
+}
+
+func (h *webhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if h.fail > 0 {
+		h.fail--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	var alert anomalyAlert
+	if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.alerts = append(h.alerts, alert)
+}
+
+func (h *webhook) Alerts() []anomalyAlert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.alerts
+}
+
+// anomalyWorker returns a worker alerting to h,
+// with a baseline of 100 egress and 10 cpu_usage a day before day.
+func anomalyWorker(t *testing.T, h *webhook, day time.Time) *Worker {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	d := &anomalyDetector{
+		WebhookURL:   srv.URL,
+		Model:        anomalyModelRatio,
+		Threshold:    3,
+		BaselineDays: 3,
+		Resources:    []string{"egress", "cpu_usage"},
+	}
+	for i := 1; i <= d.BaselineDays; i++ {
+		d.setDay(1, day.AddDate(0, 0, -i).Format(anomalyDateLayout), map[string]float64{"egress": 100, "cpu_usage": 10}, "")
+	}
+	return &Worker{Location: "test", Anomaly: d}
+}
+
+func TestCheckAnomalies(t *testing.T) {
+	var h webhook
+	day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	w := anomalyWorker(t, &h, day)
+
+	resources := []*api.CollectorProjectUsageResource{
+		{Name: "egress", Value: "1000"},
+		{Name: "cpu_usage", Value: "11"},
+		{Name: "memory", Value: "1e12"},
+	}
+	p := &api.CollectorProject{ID: 1}
+	w.checkAnomalies(t.Context(), p, day, resources)
+	w.checkAnomalies(t.Context(), p, day, resources)
+
+	alerts := h.Alerts()
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %+v", len(alerts), alerts)
+	}
+	want := anomalyAlert{
+		Location:  "test",
+		ProjectID: 1,
+		Date:      "2026-10-17",
+		Resource:  "egress",
+		Value:     1000,
+		Baseline:  100,
+		Model:     anomalyModelRatio,
+		Score:     10,
+		Threshold: 3,
+	}
+	if alerts[0] != want {
+		t.Errorf("got %+v, want %+v", alerts[0], want)
+	}
+}
+
+func TestCheckAnomaliesRetry(t *testing.T) {
+	h := webhook{fail: 1}
+	day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	w := anomalyWorker(t, &h, day)
+
+	resources := []*api.CollectorProjectUsageResource{
+		{Name: "egress", Value: "1000"},
+	}
+	p := &api.CollectorProject{ID: 1}
+
+	w.checkAnomalies(t.Context(), p, day, resources)
+	if n := len(h.Alerts()); n != 0 {
+		t.Fatalf("got %d alerts on failing webhook", n)
+	}
+
+	w.checkAnomalies(t.Context(), p, day, resources)
+	if n := len(h.Alerts()); n != 1 {
+		t.Fatalf("got %d alerts after retry, want 1", n)
+	}
+
+	w.checkAnomalies(t.Context(), p, day, resources)
+	if n := len(h.Alerts()); n != 1 {
+		t.Fatalf("got %d alerts after delivery, want 1", n)
+	}
+}
+
+func TestCheckAnomaliesBudget(t *testing.T) {
+	var h webhook
+	day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+	w := anomalyWorker(t, &h, day)
+	w.Anomaly.Budgets = map[int64]map[string]float64{
+		1: {"memory": 1e9, "egress": 1e6},
+	}
+
+	resources := []*api.CollectorProjectUsageResource{
+		{Name: "egress", Value: "100"},
+		{Name: "memory", Value: "2e9"},
+	}
+	w.checkAnomalies(t.Context(), &api.CollectorProject{ID: 1}, day, resources)
+
+	alerts := h.Alerts()
+	if len(alerts) != 1 {
+		t.Fatalf("got %d alerts, want 1: %+v", len(alerts), alerts)
+	}
+	if a := alerts[0]; a.Model != anomalyModelBudget || a.Resource != "memory" || a.Value != 2e9 || a.Threshold != 1e9 {
+		t.Errorf("got %+v", a)
+	}
+}
+
+func TestCheckAnomaliesNewProject(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Baseline []float64 // oldest first
+		Alert    bool
+	}{
+		{"no usage before", []float64{0, 0, 100, 100, 100}, true},
+		{"too few days", []float64{0, 0, 0, 100, 100}, false},
+		{"zero after usage", []float64{0, 100, 0, 100, 100}, true},
+		{"no usage", []float64{0, 0, 0, 0, 0}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			var h webhook
+			day := time.Date(2026, 10, 17, 0, 0, 0, 0, time.UTC)
+			w := anomalyWorker(t, &h, day)
+			w.Anomaly.BaselineDays = len(c.Baseline)
+			for i, v := range c.Baseline {
+				date := day.AddDate(0, 0, i-len(c.Baseline)).Format(anomalyDateLayout)
+				w.Anomaly.setDay(1, date, map[string]float64{"egress": v}, "")
+			}
+
+			resources := []*api.CollectorProjectUsageResource{
+				{Name: "egress", Value: "1000"},
+			}
+			w.checkAnomalies(t.Context(), &api.CollectorProject{ID: 1}, day, resources)
+
+			if got := len(h.Alerts()) > 0; got != c.Alert {
+				t.Errorf("alert = %v, want %v: %+v", got, c.Alert, h.Alerts())
+			}
+		})
+	}
+}
+
+func TestAnomalyResources(t *testing.T) {
+	cases := []struct {
+		Policy string
+		Want   []string
+	}{
+		{memoryBillingMax, []string{"cpu_usage", "memory", "egress"}},
+		{memoryBillingRequest, []string{"cpu_usage", "memory_request", "egress"}},
+		{memoryBillingUsage, []string{"cpu_usage", "memory_usage", "egress"}},
+		{memoryBillingOverage, []string{"cpu_usage", "memory_request", "memory_overage", "egress"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Policy, func(t *testing.T) {
+			w := &Worker{
+				PromClient:    &prom.Client{},
+				MemoryBilling: c.Policy,
+				Anomaly:       &anomalyDetector{Resources: []string{"cpu_usage", "memory", "egress"}},
+			}
+			got := w.anomalyResources(&api.CollectorProject{ID: 1})
+			if !slices.Equal(got, c.Want) {
+				t.Errorf("got %q, want %q", got, c.Want)
+			}
+		})
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		w := &Worker{
+			PromClient:    &prom.Client{},
+			MemoryBilling: memoryBillingRequest,
+			Anomaly:       &anomalyDetector{Resources: []string{"memory_request", "memory"}},
+		}
+		got := w.anomalyResources(&api.CollectorProject{ID: 1})
+		if want := []string{"memory_request"}; !slices.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+// Workload kinds of attributed pods.
+const (
+	kindDeployment  = "Deployment"
+	kindStatefulSet = "StatefulSet"
+	kindJob         = "Job"
+	kindCronJob     = "CronJob"
+	kindService     = "Service"
+	kindDisk        = "Disk"
+)
+
+var (
+	reCronJobPodName     = regexp.MustCompile(prom.CronJobPodName)
+	reDeploymentPodName  = regexp.MustCompile(prom.DeploymentPodName)
+	reStatefulSetPodName = regexp.MustCompile(prom.StatefulSetPodName)
+	reJobPodName         = regexp.MustCompile(prom.JobPodName)
+
+	rePodNameProject        = regexp.MustCompile(prom.LoosePodName)
+	reServiceNameProject    = regexp.MustCompile(`^(.+)-(\d+)$`)
+	reDeploymentNameProject = regexp.MustCompile(`^(.+)-(\d+)$`)
+	reVolumeNameProject     = regexp.MustCompile(`^(.+)-(\d+)$`)
+)
+
+// podNames are tried in order, the first match wins,
+// in the same order as prom.PodNamePatterns.
+var podNames = []struct {
+	Kind string
+	Re   *regexp.Regexp
+}{
+	{kindCronJob, reCronJobPodName},
+	{kindDeployment, reDeploymentPodName},
+	{kindStatefulSet, reStatefulSetPodName},
+	{kindJob, reJobPodName},
+	{kindDeployment, rePodNameProject},
+}
+
+// Reasons a series can not be attributed to a project.
+const (
+	reasonNoMatch        = "no_match"
+	reasonInvalidProject = "invalid_project"
+	reasonNoName         = "no_name"
+	reasonUnknownProject = "unknown_project"
+)
+
+type attribution struct {
+	ProjectID int64
+	Name      string
+	Kind      string
+}
+
+// parseName matches name against re, expecting the workload name and project id.
+func parseName(re *regexp.Regexp, kind string, name string) (attribution, bool) {
+	ns := re.FindStringSubmatch(name)
+	if len(ns) != 3 {
+		return attribution{}, false
+	}
+	projectID, _ := strconv.ParseInt(ns[2], 10, 64)
+	return attribution{
+		ProjectID: projectID,
+		Name:      ns[1],
+		Kind:      kind,
+	}, true
+}
+
+// parsePodName returns the workload of a pod from its controller naming scheme.
+func parsePodName(pod string) (attribution, bool) {
+	for _, x := range podNames {
+		if a, ok := parseName(x.Re, x.Kind, pod); ok {
+			return a, true
+		}
+	}
+	return attribution{}, false
+}
+
+// attributePod returns the project and workload of a pod or service vector,
+// or the reason it can not be attributed.
+func attributePod(v *prom.PodVector) (attribution, string) {
+	var (
+		m  attribution
+		ok bool
+	)
+	if v.Pod != "" {
+		m, ok = parsePodName(v.Pod)
+	} else if v.Service != "" {
+		m, ok = parseName(reServiceNameProject, kindService, v.Service)
+	}
+	return attribute(v.Project, v.Deployment, m, ok)
+}
+
+// attributeDeployment returns the project and workload of a deployment vector,
+// or the reason it can not be attributed.
+func attributeDeployment(v *prom.DeploymentVector) (attribution, string) {
+	m, ok := parseName(reDeploymentNameProject, kindDeployment, v.Deployment)
+	return attribute(v.Project, v.Name, m, ok)
+}
+
+// attributeVolume returns the project and disk of a volume vector,
+// or the reason it can not be attributed.
+func attributeVolume(v *prom.VolumeVector) (attribution, string) {
+	m, ok := parseName(reVolumeNameProject, kindDisk, v.Volume)
+	return attribute(v.Project, v.Disk, m, ok)
+}
+
+// attribute prefers the project and name labels,
+// and falls back to the object name match m.
+func attribute(project, name string, m attribution, matched bool) (attribution, string) {
+	if project != "" {
+		projectID, _ := strconv.ParseInt(project, 10, 64)
+		if projectID <= 0 {
+			return attribution{}, reasonInvalidProject
+		}
+		if name == "" {
+			name = m.Name
+		}
+		if name == "" {
+			return attribution{}, reasonNoName
+		}
+		return attribution{
+			ProjectID: projectID,
+			Name:      name,
+			Kind:      m.Kind,
+		}, ""
+	}
+
+	if !matched {
+		return attribution{}, reasonNoMatch
+	}
+	if m.ProjectID <= 0 {
+		return attribution{}, reasonInvalidProject
+	}
+	return m, ""
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+func TestParsePodName(t *testing.T) {
+	cases := []struct {
+		Pod  string
+		OK   bool
+		Want attribution
+	}{
+		// Deployment, <name>-<project>-<pod template hash>-<suffix>
+		{"web-12-7d9f8b6c4-x7k2p", true, attribution{12, "web", kindDeployment}},
+		{"my-app-12-5c8d94-x7k2p", true, attribution{12, "my-app", kindDeployment}},
+		// StatefulSet, <name>-<project>-<ordinal>
+		{"db-12-0", true, attribution{12, "db", kindStatefulSet}},
+		{"db-12-15", true, attribution{12, "db", kindStatefulSet}},
+		// Job, <name>-<project>-<suffix>
+		{"migrate-12-x7k2p", true, attribution{12, "migrate", kindJob}},
+		// CronJob, <name>-<project>-<scheduled unix minutes>-<suffix>
+		{"backup-12-29123456-x7k2p", true, attribution{12, "backup", kindCronJob}},
+
+		// names with digits
+		{"app2-12-7d9f8b6c4-x7k2p", true, attribution{12, "app2", kindDeployment}},
+		{"v2-api-12-0", true, attribution{12, "v2-api", kindStatefulSet}},
+		{"web-1-12-7d9f8b6c4-x7k2p", true, attribution{12, "web-1", kindDeployment}},
+
+		// app-3 in project 12, not project 3
+		{"app-3-12-0", true, attribution{12, "app-3", kindStatefulSet}},
+		{"db-3-12-x7k2p", true, attribution{12, "db-3", kindJob}},
+		// a pod template hash is at least 6 characters, a-3 is a Job in project 22
+		{"a-3-22-x7k2p", true, attribution{22, "a-3", kindJob}},
+		{"a-3-22222-x7k2p", true, attribution{22222, "a-3", kindJob}},
+		{"a-3-222222-x7k2p", true, attribution{3, "a", kindDeployment}},
+
+		// loose fallback for names of no known controller
+		{"worker-12-abc1-def0", true, attribution{12, "worker", kindDeployment}},
+		{"cron-12-123-abcde1", true, attribution{12, "cron", kindDeployment}},
+
+		{"web-x7k2p", false, attribution{}},
+		{"db-12", false, attribution{}},
+		{"", false, attribution{}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Pod, func(t *testing.T) {
+			got, ok := parsePodName(c.Pod)
+			if ok != c.OK {
+				t.Fatalf("ok = %v, want %v", ok, c.OK)
+			}
+			if got != c.Want {
+				t.Errorf("got %+v, want %+v", got, c.Want)
+			}
+		})
+	}
+}
+
+func TestPodNamesOrder(t *testing.T) {
+	if len(podNames) != len(prom.PodNamePatterns) {
+		t.Fatalf("podNames has %d patterns, prom has %d", len(podNames), len(prom.PodNamePatterns))
+	}
+	for i, x := range podNames {
+		if x.Re.String() != prom.PodNamePatterns[i] {
+			t.Errorf("pattern %d is %s, prom has %s", i, x.Re, prom.PodNamePatterns[i])
+		}
+	}
+}
+
+func TestAttributePod(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Vector prom.PodVector
+		Want   attribution
+		Reason string
+	}{
+		{"name", prom.PodVector{Pod: "web-12-7d9f8b6c4-x7k2p"}, attribution{12, "web", kindDeployment}, ""},
+		{"service", prom.PodVector{Service: "web-12"}, attribution{12, "web", kindService}, ""},
+		{"labels", prom.PodVector{Pod: "anything", Project: "7", Deployment: "api"}, attribution{ProjectID: 7, Name: "api"}, ""},
+		{"label project", prom.PodVector{Pod: "web-12-7d9f8b6c4-x7k2p", Project: "7"}, attribution{7, "web", kindDeployment}, ""},
+		{"invalid project", prom.PodVector{Pod: "web-12-7d9f8b6c4-x7k2p", Project: "x"}, attribution{}, reasonInvalidProject},
+		{"no match", prom.PodVector{Pod: "web"}, attribution{}, reasonNoMatch},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got, reason := attributePod(&c.Vector)
+			if reason != c.Reason {
+				t.Fatalf("reason = %q, want %q", reason, c.Reason)
+			}
+			if got != c.Want {
+				t.Errorf("got %+v, want %+v", got, c.Want)
+			}
+		})
+	}
+}
+
+func TestAttributeDeployment(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Vector prom.DeploymentVector
+		Want   attribution
+		Reason string
+	}{
+		{"name", prom.DeploymentVector{Deployment: "web-12"}, attribution{12, "web", kindDeployment}, ""},
+		{"name with digits", prom.DeploymentVector{Deployment: "web-1-12"}, attribution{12, "web-1", kindDeployment}, ""},
+		{"labels", prom.DeploymentVector{Deployment: "anything", Project: "7", Name: "api"}, attribution{ProjectID: 7, Name: "api"}, ""},
+		{"label project", prom.DeploymentVector{Deployment: "web-12", Project: "7"}, attribution{7, "web", kindDeployment}, ""},
+		{"no match", prom.DeploymentVector{Deployment: "web"}, attribution{}, reasonNoMatch},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got, reason := attributeDeployment(&c.Vector)
+			if reason != c.Reason {
+				t.Fatalf("reason = %q, want %q", reason, c.Reason)
+			}
+			if got != c.Want {
+				t.Errorf("got %+v, want %+v", got, c.Want)
+			}
+		})
+	}
+}
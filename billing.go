@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/deploys-app/api"
+)
+
+// Memory billing policies, each bills its own resources.
+const (
+	memoryBillingMax     = "max"     // memory: max(request, usage)
+	memoryBillingRequest = "request" // memory_request
+	memoryBillingUsage   = "usage"   // memory_usage
+	memoryBillingOverage = "overage" // memory_request and memory_overage
+)
+
+func validMemoryBilling(policy string) error {
+	switch policy {
+	case memoryBillingMax, memoryBillingRequest, memoryBillingUsage, memoryBillingOverage:
+		return nil
+	}
+	return fmt.Errorf("invalid memory billing policy %q", policy)
+}
+
+// memoryBilling returns the memory billing policy of a project.
+func (w *Worker) memoryBilling(p *api.CollectorProject) string {
+	if policy := w.ProjectMemoryBilling[p.ID]; policy != "" {
+		return policy
+	}
+	if w.MemoryBilling != "" {
+		return w.MemoryBilling
+	}
+	return memoryBillingMax
+}
+
+func (w *Worker) memorySummaries(p *api.CollectorProject) []projectSummary {
+	switch w.memoryBilling(p) {
+	case memoryBillingRequest:
+		return []projectSummary{
+			{"memory_request", w.PromClient.SummaryMemoryRequest},
+		}
+	case memoryBillingUsage:
+		return []projectSummary{
+			{"memory_usage", w.PromClient.SummaryMemoryUsage},
+		}
+	case memoryBillingOverage:
+		return []projectSummary{
+			{"memory_request", w.PromClient.SummaryMemoryRequest},
+			{"memory_overage", w.PromClient.SummaryMemoryOverage},
+		}
+	default:
+		return []projectSummary{
+			{"memory", w.PromClient.SummaryMemory},
+		}
+	}
+}
+
+// deploymentMemorySummaries returns the per deployment summaries of the
+// memory resources of memorySummaries, so the breakdown adds up to them.
+func (w *Worker) deploymentMemorySummaries(p *api.CollectorProject) []deploymentSummary {
+	switch w.memoryBilling(p) {
+	case memoryBillingRequest:
+		return []deploymentSummary{
+			{"memory_request", w.PromClient.SummaryMemoryRequestByPod},
+		}
+	case memoryBillingUsage:
+		return []deploymentSummary{
+			{"memory_usage", w.PromClient.SummaryMemoryUsageByPod},
+		}
+	case memoryBillingOverage:
+		return []deploymentSummary{
+			{"memory_request", w.PromClient.SummaryMemoryRequestByPod},
+			{"memory_overage", w.PromClient.SummaryMemoryOverageByPod},
+		}
+	default:
+		return []deploymentSummary{
+			{"memory", w.PromClient.SummaryMemoryByPod},
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+)
+
+// commands are one-off reports, run as "collector <command> [flags]"
+// with the same config as the collector.
+var commands = map[string]func(ctx context.Context, w *Worker, args []string) error{
+	"cost":      runCost,
+	"idle":      runIdle,
+	"rightsize": runRightsize,
+}
+
+func runCommand(ctx context.Context, w *Worker, name string, args []string) error {
+	f, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	return f(ctx, w, args)
+}
+
+// historyFlags are the flags of commands that analyze the usage history.
+type historyFlags struct {
+	Period time.Duration
+	Step   time.Duration
+	JSON   bool
+}
+
+func (h *historyFlags) register(fs *flag.FlagSet, period time.Duration) {
+	fs.DurationVar(&h.Period, "period", period, "history period to analyze")
+	fs.DurationVar(&h.Step, "step", 5*time.Minute, "history resolution")
+	fs.BoolVar(&h.JSON, "json", false, "print the report as json")
+}
+
+// Range returns the history range, ending at the last full step.
+func (h *historyFlags) Range() (start, end time.Time) {
+	end = time.Now().Truncate(h.Step)
+	return end.Add(-h.Period), end
+}
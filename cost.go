@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deploys-app/api"
+	"gopkg.in/yaml.v3"
+)
+
+// priceTable is the price of project usage resources, per unit of the
+// resource value, e.g. per cpu second, per byte second of memory
+// or per byte of egress.
+type priceTable struct {
+	Currency string             `yaml:"currency"`
+	Prices   map[string]float64 `yaml:"prices"`
+}
+
+func loadPriceTable(path string) (*priceTable, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var t priceTable
+	err = yaml.Unmarshal(b, &t)
+	if err != nil {
+		return nil, fmt.Errorf("invalid price table: %w", err)
+	}
+	for name, price := range t.Prices {
+		if price < 0 {
+			return nil, fmt.Errorf("invalid price table: negative price of %s", name)
+		}
+	}
+	return &t, nil
+}
+
+type resourceCost struct {
+	Name  string  `json:"name"`
+	Usage float64 `json:"usage"`
+	Price float64 `json:"price"`
+	Cost  float64 `json:"cost"`
+}
+
+type projectCost struct {
+	ProjectID int64           `json:"projectId"`
+	Resources []*resourceCost `json:"resources"`
+	Total     float64         `json:"total"`
+}
+
+// projectCost estimates the cost of p for the billing days from to to,
+// inclusive, from the same resources as the daily project usage.
+// Resources without a price are returned in unpriced.
+func (w *Worker) projectCost(ctx context.Context, p *api.CollectorProject, prices *priceTable, from, to time.Time, now time.Time) (c *projectCost, unpriced map[string]struct{}, err error) {
+	loc := w.billingLocation(p)
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+	last := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, loc)
+
+	usage := make(map[string]float64)
+	for t := start; !t.After(last) && t.Before(now); t = t.AddDate(0, 0, 1) {
+		end := t.AddDate(0, 0, 1)
+		if now.Before(end) {
+			end = now
+		}
+
+		rs, err := w.projectUsageResources(ctx, p, t, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range rs {
+			v, err := strconv.ParseFloat(r.Value, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s usage %q", r.Name, r.Value)
+			}
+			usage[r.Name] += v
+		}
+	}
+
+	c = &projectCost{ProjectID: p.ID}
+	unpriced = make(map[string]struct{})
+	for _, name := range slices.Sorted(maps.Keys(usage)) {
+		price, ok := prices.Prices[name]
+		if !ok {
+			unpriced[name] = struct{}{}
+			continue
+		}
+		r := resourceCost{
+			Name:  name,
+			Usage: usage[name],
+			Price: price,
+			Cost:  usage[name] * price,
+		}
+		c.Resources = append(c.Resources, &r)
+		c.Total += r.Cost
+	}
+	return c, unpriced, nil
+}
+
+func runCost(ctx context.Context, w *Worker, args []string) error {
+	const dateLayout = "2006-01-02"
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format(dateLayout)
+
+	fs := flag.NewFlagSet("cost", flag.ExitOnError)
+	pricesPath := fs.String("prices", config.String("price_table"), "price table file")
+	fromDate := fs.String("from", yesterday, "first billing date")
+	toDate := fs.String("to", "", "last billing date, default to from")
+	projectID := fs.Int64("project", 0, "project id, default to all active projects")
+	asJSON := fs.Bool("json", false, "print the report as json")
+	fs.Parse(args)
+
+	if *pricesPath == "" {
+		return fmt.Errorf("price table required")
+	}
+	prices, err := loadPriceTable(*pricesPath)
+	if err != nil {
+		return err
+	}
+
+	if *toDate == "" {
+		*toDate = *fromDate
+	}
+	from, err := time.Parse(dateLayout, *fromDate)
+	if err != nil {
+		return fmt.Errorf("invalid from date: %w", err)
+	}
+	to, err := time.Parse(dateLayout, *toDate)
+	if err != nil {
+		return fmt.Errorf("invalid to date: %w", err)
+	}
+	if to.Before(from) {
+		return fmt.Errorf("to date before from date")
+	}
+
+	var projectIDs []int64
+	if *projectID != 0 {
+		projectIDs = []int64{*projectID}
+	} else {
+		projects := w.activeProjects(ctx)
+		if projects == nil {
+			return fmt.Errorf("can not load active projects")
+		}
+		projectIDs = slices.Sorted(maps.Keys(projects))
+	}
+
+	now := time.Now()
+	unpriced := make(map[string]struct{})
+	var cs []*projectCost
+	for _, id := range projectIDs {
+		c, xs, err := w.projectCost(ctx, &api.CollectorProject{ID: id}, prices, from, to, now)
+		if err != nil {
+			return err
+		}
+		cs = append(cs, c)
+		maps.Copy(unpriced, xs)
+	}
+	if len(unpriced) > 0 {
+		slog.Warn("collector: resources without price", "resources", slices.Sorted(maps.Keys(unpriced)))
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(cs)
+	}
+
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "estimated cost from %s to %s\n", *fromDate, *toDate)
+	fmt.Fprintln(tw, "PROJECT\tRESOURCE\tUSAGE\tPRICE\tCOST")
+	for _, c := range cs {
+		for _, r := range c.Resources {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", c.ProjectID, r.Name, format(r.Usage), format(r.Price), strconv.FormatFloat(r.Cost, 'f', 2, 64))
+		}
+		fmt.Fprintf(tw, "%d\ttotal\t\t\t%s %s\n", c.ProjectID, strconv.FormatFloat(c.Total, 'f', 2, 64), prices.Currency)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deploys-app/api"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+func writePriceTable(t *testing.T, s string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "prices.yaml")
+	if err := os.WriteFile(path, []byte(s), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPriceTable(t *testing.T) {
+	cases := []struct {
+		Name string
+		File string
+		OK   bool
+	}{
+		{"valid", "currency: THB\nprices:\n  cpu_usage: 0.0001\n  egress: 1e-9\n", true},
+		{"free", "prices:\n  replica: 0\n", true},
+		{"empty", "", true},
+		{"negative", "prices:\n  cpu_usage: 0.0001\n  egress: -1\n", false},
+		{"not a number", "prices:\n  cpu_usage: cheap\n", false},
+		{"malformed", "prices: [cpu_usage\n", false},
+		{"wrong type", "prices:\n  - cpu_usage\n", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			_, err := loadPriceTable(writePriceTable(t, c.File))
+			if (err == nil) != c.OK {
+				t.Errorf("err = %v, want ok %v", err, c.OK)
+			}
+		})
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		_, err := loadPriceTable(filepath.Join(t.TempDir(), "missing.yaml"))
+		if err == nil {
+			t.Error("want error")
+		}
+	})
+
+	t.Run("values", func(t *testing.T) {
+		p, err := loadPriceTable(writePriceTable(t, "currency: THB\nprices:\n  cpu_usage: 0.0001\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Currency != "THB" || p.Prices["cpu_usage"] != 0.0001 {
+			t.Errorf("got %+v", p)
+		}
+	})
+}
+
+// costServer returns a prometheus stand-in answering every instant query
+// with 1 and every range query with no series, so each resource computed
+// by an instant query has a usage of 1 per billing day.
+// It records the window of each cpu usage query and its evaluation time.
+func costServer(t *testing.T) (*prom.Client, func() []string) {
+	t.Helper()
+
+	reWindow := regexp.MustCompile(`\[(\d+s)\]`)
+
+	var (
+		mu      sync.Mutex
+		windows []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		query := q.Get("query")
+
+		type result struct {
+			Metric map[string]string `json:"metric"`
+			Value  []any             `json:"value,omitempty"`
+		}
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				ResultType string   `json:"resultType"`
+				Result     []result `json:"result"`
+			} `json:"data"`
+		}
+		resp.Status = "success"
+		resp.Data.Result = []result{}
+
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			resp.Data.ResultType = "matrix"
+		case "/api/v1/query":
+			resp.Data.ResultType = "vector"
+			at, _ := strconv.ParseFloat(q.Get("time"), 64)
+			resp.Data.Result = append(resp.Data.Result, result{
+				Metric: map[string]string{},
+				Value:  []any{at, "1"},
+			})
+			if strings.Contains(query, "increase(container_cpu_usage_seconds_total") {
+				mu.Lock()
+				windows = append(windows, time.Unix(int64(at), 0).UTC().Format(time.RFC3339)+" "+reWindow.FindStringSubmatch(query)[1])
+				mu.Unlock()
+			}
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := &prom.Client{
+		Endpoint:  srv.URL,
+		Namespace: "ns",
+		Step:      time.Hour,
+	}
+	return c, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(windows)
+	}
+}
+
+func TestProjectCost(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	prices := &priceTable{
+		Currency: "USD",
+		Prices: map[string]float64{
+			"cpu_usage": 2,
+			"egress":    0.5,
+			"replica":   100, // no usage, range queries have no series
+		},
+	}
+	date := func(day int) time.Time {
+		return time.Date(2026, 11, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		Name     string
+		From, To time.Time
+		Now      time.Time
+		Windows  []string
+	}{
+		{
+			Name: "one day",
+			From: date(3), To: date(3),
+			Now: time.Date(2026, 11, 10, 0, 0, 0, 0, ny),
+			Windows: []string{
+				"2026-11-04T05:00:00Z 86400s",
+			},
+		},
+		{
+			// the fall-back day is 25 hours
+			Name: "daylight saving time",
+			From: date(1), To: date(2),
+			Now: time.Date(2026, 11, 10, 0, 0, 0, 0, ny),
+			Windows: []string{
+				"2026-11-02T05:00:00Z 90000s",
+				"2026-11-03T05:00:00Z 86400s",
+			},
+		},
+		{
+			// the current day is cut at now, days after now are skipped
+			Name: "cut at now",
+			From: date(5), To: date(9),
+			Now: time.Date(2026, 11, 6, 12, 0, 0, 0, ny),
+			Windows: []string{
+				"2026-11-06T05:00:00Z 86400s",
+				"2026-11-06T17:00:00Z 43200s",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			pc, windows := costServer(t)
+			w := &Worker{PromClient: pc, Timezone: ny}
+
+			got, unpriced, err := w.projectCost(t.Context(), &api.CollectorProject{ID: 1}, prices, c.From, c.To, c.Now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ws := windows(); !slices.Equal(ws, c.Windows) {
+				t.Errorf("cpu usage queries = %q, want %q", ws, c.Windows)
+			}
+
+			days := float64(len(c.Windows))
+			want := map[string]float64{
+				"cpu_usage": days * 2,
+				"egress":    days * 0.5,
+				"replica":   0,
+			}
+			if got.ProjectID != 1 {
+				t.Errorf("project = %d, want 1", got.ProjectID)
+			}
+			if len(got.Resources) != len(want) {
+				t.Fatalf("got %d resources, want %d", len(got.Resources), len(want))
+			}
+			for _, r := range got.Resources {
+				if math.Abs(r.Cost-want[r.Name]) > 1e-9 {
+					t.Errorf("%s cost = %v, want %v", r.Name, r.Cost, want[r.Name])
+				}
+			}
+			if math.Abs(got.Total-days*2.5) > 1e-9 {
+				t.Errorf("total = %v, want %v", got.Total, days*2.5)
+			}
+
+			for _, name := range []string{"ingress", "cpu", "memory"} {
+				if _, ok := unpriced[name]; !ok {
+					t.Errorf("%s is not unpriced", name)
+				}
+			}
+			for name := range prices.Prices {
+				if _, ok := unpriced[name]; ok {
+					t.Errorf("%s is unpriced", name)
+				}
+			}
+		})
+	}
+}
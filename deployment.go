@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/deploys-app/api"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+// containerSuffix is appended to the usage name of per container items,
+// their pod is reported as "<pod>/<container>".
+const containerSuffix = "_container"
+
+// resolve checks attribution a of series against the active projects.
+// Series that can not be attributed are recorded, then dropped or moved
+// to the unattributed project.
+func (w *Worker) resolve(typ, name, series string, a attribution, reason string, projects map[int64]struct{}) (attribution, bool) {
+	if reason == "" && projects != nil {
+		if _, ok := projects[a.ProjectID]; !ok {
+			reason = reasonUnknownProject
+		}
+	}
+	if reason == "" {
+		return a, true
+	}
+
+	w.unattributed(typ, name, series, reason)
+	if w.UnattributedProjectID == 0 {
+		return attribution{}, false
+	}
+	return attribution{ProjectID: w.UnattributedProjectID, Name: reason}, true
+}
+
+// unattributed records a series that can not be attributed to a project.
+func (w *Worker) unattributed(typ, name, series, reason string) {
+	unattributedSeries.Inc(typ, name, reason)
+
+	if ok, suppressed := w.unattributedLog.Allow(typ + "/" + name + "/" + reason); ok {
+		slog.Warn("collector: unattributed series", "type", typ, "name", name, "series", series, "reason", reason, "suppressed", suppressed)
+	}
+}
+
+// nonFinite records samples of query dropped for a non-finite value.
+func (w *Worker) nonFinite(query string, dropped int) {
+	nonFiniteSamples.Add(float64(dropped))
+
+	if ok, suppressed := w.nonFiniteLog.Allow(query); ok {
+		slog.Warn("collector: dropped non-finite samples", "query", query, "dropped", dropped, "suppressed", suppressed)
+	}
+}
+
+func (w *Worker) syncDeploymentUsage(ctx context.Context) {
+	projects := w.activeProjects(ctx)
+	if projects == nil {
+		slog.Warn("collector: active projects not loaded, skip project filter")
+	}
+
+	syncVector := func(name string, f func(context.Context) ([]*prom.PodVector, error)) error {
+		slog.Info("collector: sync deployment", "name", name)
+
+		vs, err := f(ctx)
+		if err != nil {
+			slog.Error("collector: sync deployment error", "name", name, "error", err)
+			return err
+		}
+
+		req := api.CollectorSetDeploymentUsage{
+			Location: w.Location,
+		}
+
+		// the api has no field for the workload kind, it is reported
+		// in the log and collector_usage_pods_total instead
+		kinds := make(map[string]int)
+
+		// series are per container, report one item per pod with the sum of its
+		// containers, unless pod level series (no container label) exist,
+		// then with the sum of the pod level series, e.g. per network interface.
+		type podItem struct {
+			*api.CollectorDeploymentUsageItem
+			podLevel bool
+			podSum   float64
+		}
+		pods := make(map[string]*podItem)
+		var containers []*api.CollectorDeploymentUsageItem
+
+		for _, v := range vs {
+			at := v.Time.Unix()
+
+			pod := v.Pod
+			if pod == "" {
+				pod = v.Service
+			}
+
+			a, reason := attributePod(v)
+			a, ok := w.resolve("deployment", name, pod, a, reason, projects)
+			if !ok {
+				continue
+			}
+
+			p := pods[pod]
+			if p == nil {
+				p = &podItem{
+					CollectorDeploymentUsageItem: &api.CollectorDeploymentUsageItem{
+						ProjectID:      a.ProjectID,
+						DeploymentName: a.Name,
+						Name:           name,
+						Pod:            pod,
+						At:             at,
+					},
+				}
+				pods[pod] = p
+				req.List = append(req.List, p.CollectorDeploymentUsageItem)
+				kinds[a.Kind]++
+				usagePods.Inc(name, a.Kind)
+			}
+			if at > p.At {
+				p.At = at
+			}
+
+			if v.Container == "" {
+				p.podLevel = true
+				p.podSum += v.Value
+			} else {
+				p.Value += v.Value
+			}
+
+			if v.Container != "" && w.ContainerUsage {
+				containers = append(containers, &api.CollectorDeploymentUsageItem{
+					ProjectID:      a.ProjectID,
+					DeploymentName: a.Name,
+					Name:           name + containerSuffix,
+					Pod:            pod + "/" + v.Container,
+					Value:          v.Value,
+					At:             at,
+				})
+			}
+		}
+		for _, p := range pods {
+			if p.podLevel {
+				p.Value = p.podSum
+			}
+		}
+		req.List = append(req.List, containers...)
+
+		if len(req.List) == 0 {
+			return nil
+		}
+		slog.Info("collector: sync deployment items", "name", name, "items", len(req.List), "kinds", kinds)
+
+		_, err = w.Client.Collector().SetDeploymentUsage(ctx, &req)
+		if err != nil {
+			slog.Error("collector: sync deployment error", "name", name, "error", err)
+			return err
+		}
+		return nil
+	}
+
+	syncDiskVector := func(name string, f func(context.Context) ([]*prom.VolumeVector, error)) error {
+		slog.Info("collector: sync disk", "name", name)
+
+		vs, err := f(ctx)
+		if err != nil {
+			slog.Error("collector: sync disk error", "name", name, "error", err)
+			return err
+		}
+
+		req := api.CollectorSetDiskUsage{
+			Location: w.Location,
+		}
+
+		for _, v := range vs {
+			at := v.Time.Unix()
+
+			a, reason := attributeVolume(v)
+			a, ok := w.resolve("disk", name, v.Volume, a, reason, projects)
+			if !ok {
+				continue
+			}
+
+			req.List = append(req.List, &api.CollectorDiskUsageItem{
+				ProjectID: a.ProjectID,
+				DiskName:  a.Name,
+				Name:      name,
+				Value:     v.Value,
+				At:        at,
+			})
+		}
+
+		if len(req.List) == 0 {
+			return nil
+		}
+
+		_, err = w.Client.Collector().SetDiskUsage(ctx, &req)
+		if err != nil {
+			slog.Error("collector: sync disk error", "name", name, "error", err)
+			return err
+		}
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("cpu_usage", w.PromClient.GetCPUUsage)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("cpu", w.PromClient.GetCPU)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("cpu_limit", w.PromClient.GetCPULimit)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("memory_usage", w.PromClient.GetMemoryUsage)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("memory", w.PromClient.GetMemory)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("memory_limit", w.PromClient.GetMemoryLimit)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("ephemeral_storage_usage", w.PromClient.GetEphemeralStorageUsage)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("egress", w.PromClient.GetEgress)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("ingress", w.PromClient.GetIngress)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("requests", w.PromClient.GetRequests)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("requests_2xx", w.PromClient.GetRequests2xx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("requests_4xx", w.PromClient.GetRequests4xx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("requests_5xx", w.PromClient.GetRequests5xx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("latency_p95", w.PromClient.GetLatencyP95)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("latency_p99", w.PromClient.GetLatencyP99)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("cpu_throttled", w.PromClient.GetCPUThrottled)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("oom_kills", w.PromClient.GetOOMKills)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncVector("restarts", w.PromClient.GetRestarts)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncDiskVector("disk_usage", w.PromClient.GetDiskUsage)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncDiskVector("disk_size", w.PromClient.GetDiskSize)
+	}()
+
+	diskIO := []struct {
+		Name   string
+		Metric string
+		F      func(context.Context) ([]*prom.VolumeVector, error)
+	}{
+		{"disk_read_iops", w.PromClient.DiskIOMetrics.ReadOps, w.PromClient.GetDiskReadIOPS},
+		{"disk_write_iops", w.PromClient.DiskIOMetrics.WriteOps, w.PromClient.GetDiskWriteIOPS},
+		{"disk_read_throughput", w.PromClient.DiskIOMetrics.ReadBytes, w.PromClient.GetDiskReadThroughput},
+		{"disk_write_throughput", w.PromClient.DiskIOMetrics.WriteBytes, w.PromClient.GetDiskWriteThroughput},
+	}
+	for _, x := range diskIO {
+		if x.Metric == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			syncDiskVector(x.Name, x.F)
+		}()
+	}
+
+	if w.PromClient.SnapshotMetric != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			syncDiskVector("snapshot_size", w.PromClient.GetSnapshotSize)
+		}()
+	}
+
+	for _, r := range w.ExtendedResources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			syncVector(prom.ResourceName(r), func(ctx context.Context) ([]*prom.PodVector, error) {
+				return w.PromClient.GetResourceRequests(ctx, r)
+			})
+		}()
+	}
+
+	wg.Wait()
+}
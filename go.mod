@@ -6,6 +6,7 @@ require (
 	github.com/acoshift/configfile v1.9.0
 	github.com/deploys-app/api v0.0.0-20250215111606-eb6e00c1babf
 	golang.org/x/sync v0.11.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -17,5 +18,4 @@ require (
 	github.com/moonrhythm/validator v1.3.0 // indirect
 	github.com/rogpeppe/go-internal v1.11.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+// Recommendations of idle deployments.
+const (
+	idleScaleToZero = "scale to zero"
+	idleNeedsReview = "needs review" // requests are unknown
+)
+
+// idleDeployment is a deployment that used no more than the cpu threshold
+// during the whole period. It can be scaled to zero if it also served
+// no more than the request threshold, or needs review if its requests
+// are unknown.
+type idleDeployment struct {
+	ProjectID      int64    `json:"projectId"`
+	Name           string   `json:"name"`
+	Kind           string   `json:"kind"`
+	Pods           int      `json:"pods"`
+	PeakCPU        float64  `json:"peakCpu"`  // cores, sum of all pods
+	Requests       *float64 `json:"requests"` // total over the period, nil if unknown
+	Recommendation string   `json:"recommendation"`
+}
+
+// idleDeployments finds idle deployments over [start, end].
+// Deployments younger than the period are never idle.
+//
+// Requests are attributed by service name while pods may be attributed by
+// labels, so requests are matched on either name. When labels are set and
+// no requests match, the requests of the deployment are unknown and only
+// its cpu usage is checked.
+func (w *Worker) idleDeployments(ctx context.Context, start, end time.Time, step time.Duration, maxCPU, maxRequests float64) ([]*idleDeployment, error) {
+	var cpu, reqs []*prom.PodSeries
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		var err error
+		cpu, err = w.PromClient.HistoryCPUUsage(gctx, start, end, step)
+		return err
+	})
+	g.Go(func() error {
+		var err error
+		reqs, err = w.PromClient.HistoryRequests(gctx, start, end, step)
+		return err
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	projects := w.activeProjects(ctx)
+	cpuWorkloads := groupWorkloads(cpu, projects)
+	reqWorkloads := groupWorkloads(reqs, projects)
+
+	var rs []*idleDeployment
+	for _, k := range sortedWorkloads(cpuWorkloads) {
+		x := cpuWorkloads[k]
+		if x.First().After(start.Add(step)) {
+			continue
+		}
+
+		var peak float64
+		for _, p := range x.Sum() {
+			peak = max(peak, p.Value)
+		}
+		if peak > maxCPU {
+			continue
+		}
+
+		r := reqWorkloads[k]
+		for _, nk := range x.NameKeys() {
+			if r != nil {
+				break
+			}
+			r = reqWorkloads[nk]
+		}
+
+		var requests *float64
+		switch {
+		case r != nil:
+			var total float64
+			for _, s := range r.Series {
+				total += s.IntegrateTrapezoid(step)
+			}
+			requests = &total
+		case w.PromClient.ProjectLabel == "":
+			// services and pods are named the same, no series is no request
+			requests = new(float64)
+		default:
+			slog.Warn("collector: no requests match deployment, check cpu only", "project", k.ProjectID, "deployment", k.Name)
+		}
+		if requests != nil && *requests > maxRequests {
+			continue
+		}
+
+		recommendation := idleScaleToZero
+		if requests == nil {
+			recommendation = idleNeedsReview
+		}
+		rs = append(rs, &idleDeployment{
+			ProjectID:      k.ProjectID,
+			Name:           k.Name,
+			Kind:           x.Kind,
+			Pods:           len(x.Series),
+			PeakCPU:        peak,
+			Requests:       requests,
+			Recommendation: recommendation,
+		})
+	}
+	return rs, nil
+}
+
+func runIdle(ctx context.Context, w *Worker, args []string) error {
+	var h historyFlags
+	fs := flag.NewFlagSet("idle", flag.ExitOnError)
+	h.register(fs, 7*24*time.Hour)
+	maxCPU := fs.Float64("cpu", 0.01, "max peak cpu usage in cores")
+	maxRequests := fs.Float64("requests", 0, "max total requests")
+	fs.Parse(args)
+
+	start, end := h.Range()
+	rs, err := w.idleDeployments(ctx, start, end, h.Step, *maxCPU, *maxRequests)
+	if err != nil {
+		return err
+	}
+
+	if h.JSON {
+		return json.NewEncoder(os.Stdout).Encode(rs)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "idle deployments from %s to %s\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+	writeIdle(tw, rs, idleScaleToZero)
+
+	// cpu is idle but requests could not be matched, do not recommend scaling
+	if slices.ContainsFunc(rs, func(r *idleDeployment) bool { return r.Recommendation == idleNeedsReview }) {
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "idle cpu with unknown requests, check traffic before scaling")
+		writeIdle(tw, rs, idleNeedsReview)
+	}
+	return tw.Flush()
+}
+
+// writeIdle writes the table of idle deployments with the recommendation.
+func writeIdle(w io.Writer, rs []*idleDeployment, recommendation string) {
+	fmt.Fprintln(w, "PROJECT\tDEPLOYMENT\tKIND\tPODS\tPEAK CPU\tREQUESTS\tRECOMMENDATION")
+	for _, r := range rs {
+		if r.Recommendation != recommendation {
+			continue
+		}
+		requests := "unknown"
+		if r.Requests != nil {
+			requests = strconv.FormatFloat(*r.Requests, 'f', 0, 64)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			r.ProjectID, r.Name, r.Kind, r.Pods,
+			strconv.FormatFloat(r.PeakCPU, 'f', 4, 64),
+			requests, r.Recommendation,
+		)
+	}
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/acoshift/configfile"
 	"github.com/deploys-app/api"
@@ -35,10 +37,98 @@ func main() {
 		os.Exit(1)
 	}
 
+	tz, err := time.LoadLocation(config.StringDefault("billing_timezone", "UTC"))
+	if err != nil {
+		slog.Error("invalid billing timezone", "error", err)
+		os.Exit(1)
+	}
+
+	projectTimezones := make(map[int64]*time.Location)
+	projectTimezoneNames, err := parseProjectMap(config.String("project_timezones"))
+	if err != nil {
+		slog.Error("invalid project timezones", "error", err)
+		os.Exit(1)
+	}
+	for id, name := range projectTimezoneNames {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			slog.Error("invalid project timezone", "project", id, "error", err)
+			os.Exit(1)
+		}
+		projectTimezones[id] = loc
+	}
+
+	memoryBilling := config.StringDefault("memory_billing", memoryBillingMax)
+	if err := validMemoryBilling(memoryBilling); err != nil {
+		slog.Error("invalid memory billing", "error", err)
+		os.Exit(1)
+	}
+
+	projectMemoryBilling, err := parseProjectMap(config.String("project_memory_billing"))
+	if err != nil {
+		slog.Error("invalid project memory billing", "error", err)
+		os.Exit(1)
+	}
+	for id, policy := range projectMemoryBilling {
+		if err := validMemoryBilling(policy); err != nil {
+			slog.Error("invalid project memory billing", "project", id, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	extendedResources := splitList(config.String("extended_resources"))
+	if err := validExtendedResources(extendedResources); err != nil {
+		slog.Error("invalid extended resources", "error", err)
+		os.Exit(1)
+	}
+
+	var anomaly *anomalyDetector
+	if config.String("anomaly_webhook") == "" && config.String("usage_budgets") != "" {
+		slog.Error("usage budgets require anomaly webhook")
+		os.Exit(1)
+	}
+	if webhook := config.String("anomaly_webhook"); webhook != "" {
+		anomaly = &anomalyDetector{
+			WebhookURL:   webhook,
+			HTTPClient:   httpClient,
+			Model:        config.StringDefault("anomaly_model", anomalyModelRatio),
+			Threshold:    config.Float64Default("anomaly_threshold", 3),
+			BaselineDays: config.IntDefault("anomaly_baseline_days", 7),
+			Resources:    splitList(config.StringDefault("anomaly_resources", "cpu_usage,memory,egress")),
+		}
+
+		anomaly.Budgets, err = parseBudgets(config.String("usage_budgets"))
+		if err != nil {
+			slog.Error("invalid usage budgets", "error", err)
+			os.Exit(1)
+		}
+		if err := validAnomalyModel(anomaly.Model); err != nil {
+			slog.Error("invalid anomaly model", "error", err)
+			os.Exit(1)
+		}
+		if anomaly.Threshold <= 0 || anomaly.BaselineDays < minAnomalyBaseline {
+			slog.Error("invalid anomaly threshold or baseline days")
+			os.Exit(1)
+		}
+	}
+
 	w := Worker{
 		PromClient: &prom.Client{
 			Namespace: namespace,
 			Endpoint:  config.MustString("prom_endpoint"),
+			Step:      config.DurationDefault("prom_step", time.Minute),
+
+			ProjectLabel:  config.String("project_label"),
+			NameLabel:     config.String("name_label"),
+			LatencyMetric: config.String("latency_metric"),
+			DiskIOMetrics: prom.DiskIOMetrics{
+				ReadOps:    config.String("disk_read_ops_metric"),
+				WriteOps:   config.String("disk_write_ops_metric"),
+				ReadBytes:  config.String("disk_read_bytes_metric"),
+				WriteBytes: config.String("disk_write_bytes_metric"),
+			},
+			SnapshotMetric:      config.String("snapshot_metric"),
+			SnapshotSourceLabel: config.String("snapshot_source_label"),
 		},
 		Client: &client.Client{
 			Endpoint:   config.String("api_endpoint"),
@@ -47,7 +137,51 @@ func main() {
 				r.Header.Set("Authorization", "Bearer "+token)
 			},
 		},
-		Location: config.MustString("location"),
+		Location:        config.MustString("location"),
+		HourlyUsage:     config.Bool("hourly_usage"),
+		ContainerUsage:  config.Bool("container_usage"),
+		DeploymentUsage: config.Bool("deployment_usage"),
+		VerifyNetwork:   config.Bool("verify_network"),
+
+		ExtendedResources:    extendedResources,
+		MemoryBilling:        memoryBilling,
+		ProjectMemoryBilling: projectMemoryBilling,
+
+		Timezone:         tz,
+		ProjectTimezones: projectTimezones,
+
+		UnattributedProjectID: config.Int64("unattributed_project_id"),
+		unattributedLog: logLimiter{
+			Interval: config.DurationDefault("unattributed_log_interval", 10*time.Minute),
+		},
+		nonFiniteLog: logLimiter{
+			Interval: config.DurationDefault("nonfinite_log_interval", 10*time.Minute),
+		},
+		ProjectRefreshInterval: config.DurationDefault("project_refresh_interval", 5*time.Minute),
+
+		Anomaly: anomaly,
+	}
+
+	w.PromClient.OnNonFinite = w.nonFinite
+
+	if len(os.Args) > 1 {
+		err := runCommand(context.Background(), &w, os.Args[1], os.Args[2:])
+		if err != nil {
+			slog.Error("command error", "command", os.Args[1], "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if addr := config.String("metrics_addr"); addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		go func() {
+			err := http.ListenAndServe(addr, mux)
+			if err != nil {
+				slog.Error("metrics server error", "error", err)
+			}
+		}()
 	}
 
 	stopSignal := make(chan os.Signal, 1)
@@ -94,10 +228,84 @@ func main() {
 	wg.Wait()
 }
 
+// parseProjectMap parses "<project id>=<value>" pairs separated by comma.
+func parseProjectMap(s string) (map[int64]string, error) {
+	m := make(map[int64]string)
+	for _, kv := range splitList(s) {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q", kv)
+		}
+		id, err := strconv.ParseInt(strings.TrimSpace(k), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project id %q", k)
+		}
+		m[id] = strings.TrimSpace(v)
+	}
+	return m, nil
+}
+
+// splitList splits a comma separated list, skipping empty items.
+func splitList(s string) []string {
+	var xs []string
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x != "" {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
 type Worker struct {
 	PromClient *prom.Client
 	Location   string
 	Client     api.Interface
+
+	// HourlyUsage also submits project usage per hour bucket
+	HourlyUsage bool
+
+	// ContainerUsage also submits deployment usage per container
+	ContainerUsage bool
+
+	// DeploymentUsage also submits project usage per deployment
+	DeploymentUsage bool
+
+	// MemoryBilling is the memory billing policy, default to max.
+	// ProjectMemoryBilling overrides it per project.
+	MemoryBilling        string
+	ProjectMemoryBilling map[int64]string
+
+	// ExtendedResources are kubernetes resource names, e.g. nvidia.com/gpu,
+	// whose requests are reported as deployment usage and project resources.
+	ExtendedResources []string
+
+	// VerifyNetwork logs daily network resources against the former
+	// max - min computation
+	VerifyNetwork bool
+
+	// UnattributedProjectID is the project that receives usage
+	// of series that can not be attributed, 0 to drop them.
+	UnattributedProjectID int64
+
+	unattributedLog logLimiter
+
+	// nonFiniteLog limits logs of dropped non-finite samples per query.
+	nonFiniteLog logLimiter
+
+	// ProjectRefreshInterval is how often active projects are reloaded
+	// for the deployment loop.
+	ProjectRefreshInterval time.Duration
+
+	projects projectCache
+
+	// Timezone is the billing day time zone for the location, default to UTC.
+	// ProjectTimezones overrides it per project.
+	Timezone         *time.Location
+	ProjectTimezones map[int64]*time.Location
+
+	// Anomaly alerts daily project usage above its baseline, nil to disable.
+	Anomaly *anomalyDetector
 }
 
 func (w *Worker) RunProject() {
@@ -108,6 +316,7 @@ func (w *Worker) RunProject() {
 		slog.Error("collector: get location data", "error", err)
 		return
 	}
+	w.projects.set(l.Projects)
 
 	sem := semaphore.NewWeighted(10)
 	for _, p := range l.Projects {
@@ -130,299 +339,3 @@ func (w *Worker) RunDeployment() {
 
 	w.syncDeploymentUsage(ctx)
 }
-
-func (w *Worker) syncProjectUsage(ctx context.Context, p *api.CollectorProject) {
-	slog.Info("collector: sync project", "project", p.ID)
-
-	now := time.Now()
-	t := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-
-	// calculate yesterday, if time < 5am
-	if now.Hour() <= 5 {
-		yesterday := t.AddDate(0, 0, -1)
-		w.syncProjectUsageDate(ctx, p, yesterday, now)
-	}
-
-	// calculate today
-	w.syncProjectUsageDate(ctx, p, t, now)
-}
-
-func (w *Worker) syncProjectUsageDate(ctx context.Context, p *api.CollectorProject, t time.Time, now time.Time) {
-	et := t.AddDate(0, 0, 1)
-	days := "1d"
-
-	n := now
-	if n.Before(et) {
-		n = et
-	}
-	rangeSeconds := int64(n.Sub(t) / time.Second)
-
-	req := api.CollectorSetProjectUsage{
-		Location:  w.Location,
-		ProjectID: p.ID,
-		At:        t.Format(time.RFC3339),
-	}
-
-	// cpu usage
-	value, err := w.PromClient.SummaryCPUUsage(p.ID, et.Unix(), days, rangeSeconds)
-	if err != nil {
-		slog.Error("collector: get prom summary cpu usage error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "cpu_usage", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "cpu_usage",
-		Value: value,
-	})
-
-	// cpu
-	value, err = w.PromClient.SummaryCPU(p.ID, et.Unix(), days, rangeSeconds)
-	if err != nil {
-		slog.Error("collector: get prom summary cpu error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "cpu", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "cpu",
-		Value: value,
-	})
-
-	// memory
-	value, err = w.PromClient.SummaryMemory(p.ID, et.Unix(), days, rangeSeconds)
-	if err != nil {
-		slog.Error("collector: get prom summary memory error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "memory", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "memory",
-		Value: value,
-	})
-
-	// egress
-	value, err = w.PromClient.SummaryEgress(p.ID, et.Unix(), days)
-	if err != nil {
-		slog.Error("collector: get prom summary egress error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "egress", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "egress",
-		Value: value,
-	})
-
-	// disk
-	value, err = w.PromClient.SummaryDisk(p.ID, et.Unix(), days, rangeSeconds)
-	if err != nil {
-		slog.Error("collector: get prom summary disk error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "disk", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "disk",
-		Value: value,
-	})
-
-	// replica
-	value, err = w.PromClient.SummaryReplica(p.ID, et.Unix(), days, rangeSeconds)
-	if err != nil {
-		slog.Error("collector: get prom summary replica error", "error", err)
-		return
-	}
-	slog.Info("collector: syncProjectUsageDate", "resource", "replica", "project", p.ID, "value", value)
-	req.Resources = append(req.Resources, &api.CollectorProjectUsageResource{
-		Name:  "replica",
-		Value: value,
-	})
-
-	if len(req.Resources) == 0 {
-		return
-	}
-
-	_, err = w.Client.Collector().SetProjectUsage(ctx, &req)
-	if err != nil {
-		slog.Error("collector: set project usage error", "error", err)
-		return
-	}
-}
-
-var (
-	rePodNameProject     = regexp.MustCompile(`^(.+)-(\d+)-[^-]+-[^-]+$`)
-	reServiceNameProject = regexp.MustCompile(`^(.+)-(\d+)$`)
-	reVolumeNameProject  = regexp.MustCompile(`^(.+)-(\d+)$`)
-)
-
-func (w *Worker) syncDeploymentUsage(ctx context.Context) {
-	syncVector := func(name string, f func() ([]*prom.PodVector, error)) error {
-		slog.Info("collector: sync deployment", "name", name)
-
-		vs, err := f()
-		if err != nil {
-			slog.Error("collector: sync deployment error", "name", name, "error", err)
-			return err
-		}
-
-		req := api.CollectorSetDeploymentUsage{
-			Location: w.Location,
-		}
-
-		for _, v := range vs {
-			at := v.Time
-
-			var (
-				ns  [][]string
-				pod string
-			)
-			if v.Pod != "" {
-				pod = v.Pod
-				ns = rePodNameProject.FindAllStringSubmatch(pod, -1)
-			} else if v.Service != "" {
-				pod = v.Service
-				ns = reServiceNameProject.FindAllStringSubmatch(pod, -1)
-			}
-			if len(ns) != 1 || len(ns[0]) != 3 {
-				continue
-			}
-			projectID, _ := strconv.ParseInt(ns[0][2], 10, 64)
-			if projectID == 0 {
-				continue
-			}
-
-			f, _ := strconv.ParseFloat(v.Value, 64)
-
-			req.List = append(req.List, &api.CollectorDeploymentUsageItem{
-				ProjectID:      projectID,
-				DeploymentName: ns[0][1],
-				Name:           name,
-				Pod:            pod,
-				Value:          f,
-				At:             at,
-			})
-		}
-
-		if len(req.List) == 0 {
-			return nil
-		}
-
-		_, err = w.Client.Collector().SetDeploymentUsage(ctx, &req)
-		if err != nil {
-			slog.Error("collector: sync deployment error", "name", name, "error", err)
-			return err
-		}
-		return nil
-	}
-
-	syncDiskVector := func(name string, f func() ([]*prom.VolumeVector, error)) error {
-		slog.Info("collector: sync disk", "name", name)
-
-		vs, err := f()
-		if err != nil {
-			slog.Error("collector: sync disk error", "name", name, "error", err)
-			return err
-		}
-
-		req := api.CollectorSetDiskUsage{
-			Location: w.Location,
-		}
-
-		for _, v := range vs {
-			at := v.Time
-
-			var (
-				ns [][]string
-			)
-			ns = reVolumeNameProject.FindAllStringSubmatch(v.Volume, -1)
-			if len(ns) != 1 || len(ns[0]) != 3 {
-				continue
-			}
-			projectID, _ := strconv.ParseInt(ns[0][2], 10, 64)
-			if projectID == 0 {
-				continue
-			}
-
-			f, _ := strconv.ParseFloat(v.Value, 64)
-
-			req.List = append(req.List, &api.CollectorDiskUsageItem{
-				ProjectID: projectID,
-				DiskName:  ns[0][1],
-				Name:      name,
-				Value:     f,
-				At:        at,
-			})
-		}
-
-		if len(req.List) == 0 {
-			return nil
-		}
-
-		_, err = w.Client.Collector().SetDiskUsage(ctx, &req)
-		if err != nil {
-			slog.Error("collector: sync disk error", "name", name, "error", err)
-			return err
-		}
-		return nil
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("cpu_usage", w.PromClient.GetCPUUsage)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("cpu", w.PromClient.GetCPU)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("cpu_limit", w.PromClient.GetCPULimit)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("memory_usage", w.PromClient.GetMemoryUsage)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("memory", w.PromClient.GetMemory)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("memory_limit", w.PromClient.GetMemoryLimit)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("egress", w.PromClient.GetEgress)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncVector("requests", w.PromClient.GetRequests)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncDiskVector("disk_usage", w.PromClient.GetDiskUsage)
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		syncDiskVector("disk_size", w.PromClient.GetDiskSize)
-	}()
-
-	wg.Wait()
-}
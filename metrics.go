@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// counter is a prometheus counter with labels.
+type counter struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var metrics []*counter
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: make(map[string]float64),
+	}
+	metrics = append(metrics, c)
+	return c
+}
+
+// Inc increments the counter for labelValues, in the order of c.Labels.
+func (c *counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for labelValues, in the order of c.Labels.
+func (c *counter) Add(v float64, labelValues ...string) {
+	var b strings.Builder
+	for i, l := range c.Labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		var lv string
+		if i < len(labelValues) {
+			lv = labelValues[i]
+		}
+		fmt.Fprintf(&b, "%s=%s", l, strconv.Quote(lv))
+	}
+
+	c.mu.Lock()
+	c.values[b.String()] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.Name, c.Help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.Name)
+
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		v := strconv.FormatFloat(c.values[k], 'f', -1, 64)
+		if k == "" {
+			fmt.Fprintf(w, "%s %s\n", c.Name, v)
+			continue
+		}
+		fmt.Fprintf(w, "%s{%s} %s\n", c.Name, k, v)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range metrics {
+		c.writeTo(w)
+	}
+}
+
+var unattributedSeries = newCounter(
+	"collector_unattributed_series_total",
+	"Series that could not be attributed to a project.",
+	"type", "name", "reason",
+)
+
+var usagePods = newCounter(
+	"collector_usage_pods_total",
+	"Pods reported in deployment usage by workload kind.",
+	"name", "kind",
+)
+
+var nonFiniteSamples = newCounter(
+	"collector_nonfinite_samples_total",
+	"Prometheus samples dropped for a non-finite value.",
+)
+
+// logLimiter limits logs per key to once per interval.
+type logLimiter struct {
+	Interval time.Duration
+
+	mu         sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
+
+// Allow reports whether key can be logged now,
+// and how many logs of key were suppressed since the last allowed one.
+func (l *logLimiter) Allow(key string) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+		l.suppressed = make(map[string]int)
+	}
+
+	now := time.Now()
+	if t, ok := l.last[key]; ok && now.Sub(t) < l.Interval {
+		l.suppressed[key]++
+		return false, 0
+	}
+
+	n := l.suppressed[key]
+	l.last[key] = now
+	delete(l.suppressed, key)
+	return true, n
+}
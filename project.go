@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/deploys-app/api"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+// hourlySuffix is appended to resource names of hourly buckets,
+// so they do not collide with the daily total at midnight.
+const hourlySuffix = "_hourly"
+
+func (w *Worker) syncProjectUsage(ctx context.Context, p *api.CollectorProject) {
+	slog.Info("collector: sync project", "project", p.ID)
+
+	now := time.Now().In(w.billingLocation(p))
+	t := billingDay(now)
+
+	// calculate yesterday, until its usage is final
+	if recomputeYesterday(now) {
+		yesterday := t.AddDate(0, 0, -1)
+		resources := w.syncProjectUsageDate(ctx, p, yesterday, now)
+		if w.Anomaly != nil && resources != nil {
+			w.checkAnomalies(ctx, p, yesterday, resources)
+		}
+	}
+
+	// calculate today
+	w.syncProjectUsageDate(ctx, p, t, now)
+
+	if w.HourlyUsage {
+		h := truncateHour(now)
+
+		// finalize previous hour, then update current hour
+		w.syncProjectUsageHour(ctx, p, h.Add(-time.Hour), now)
+		w.syncProjectUsageHour(ctx, p, h, now)
+	}
+}
+
+// billingLocation returns the time zone that project billing days align to.
+func (w *Worker) billingLocation(p *api.CollectorProject) *time.Location {
+	if loc := w.ProjectTimezones[p.ID]; loc != nil {
+		return loc
+	}
+	if w.Timezone != nil {
+		return w.Timezone
+	}
+	return time.UTC
+}
+
+// billingDay returns the start of the local day of t.
+// It is not always 24 hours before the next one, t.AddDate(0, 0, 1)
+// follows daylight saving time.
+func billingDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// recomputeYesterday reports whether yesterday is calculated again at now,
+// until 5:59 local time, for late samples and the previous sync to finish.
+func recomputeYesterday(now time.Time) bool {
+	return now.Hour() <= 5
+}
+
+// truncateHour truncates t to the start of its local hour,
+// unlike time.Truncate which aligns to UTC hours.
+func truncateHour(t time.Time) time.Time {
+	return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+func (w *Worker) syncProjectUsageDate(ctx context.Context, p *api.CollectorProject, t time.Time, now time.Time) []*api.CollectorProjectUsageResource {
+	return w.syncProjectUsageRange(ctx, p, t, t.AddDate(0, 0, 1), now, usageDate(t), "")
+}
+
+func (w *Worker) syncProjectUsageHour(ctx context.Context, p *api.CollectorProject, t time.Time, now time.Time) []*api.CollectorProjectUsageResource {
+	return w.syncProjectUsageRange(ctx, p, t, t.Add(time.Hour), now, usageHour(t), hourlySuffix)
+}
+
+// usageDate formats the start of a daily usage bucket as its local date
+// at UTC, e.g. 2026-10-18T00:00:00Z for a day starting at midnight +07:00.
+// An offset would move the bucket to the previous date if the api
+// buckets by the UTC date of At.
+func usageDate(start time.Time) string {
+	return time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+}
+
+// usageHour formats the start of an hourly usage bucket as its instant at UTC,
+// matching At of deployment usage. The local hour would merge the repeated
+// hour of a daylight saving time change into one bucket.
+func usageHour(start time.Time) string {
+	return start.UTC().Format(time.RFC3339)
+}
+
+// syncProjectUsageRange submits project usage for [start, end) at start,
+// the range is cut at now if it is not closed yet.
+// It returns the submitted resources, or nil if nothing was submitted.
+func (w *Worker) syncProjectUsageRange(ctx context.Context, p *api.CollectorProject, start, end time.Time, now time.Time, at, suffix string) []*api.CollectorProjectUsageResource {
+	if now.Before(end) {
+		end = now
+	}
+
+	resources, err := w.projectUsageResources(ctx, p, start, end)
+	if err != nil {
+		return nil
+	}
+	if w.DeploymentUsage {
+		// the breakdown is optional, submit the project usage without it
+		rs, err := w.deploymentUsageResources(ctx, p, start, end)
+		if err == nil {
+			resources = append(resources, rs...)
+		}
+	}
+	if w.VerifyNetwork && suffix == "" {
+		w.verifyNetwork(ctx, p, start, end, resources)
+	}
+	if len(resources) == 0 {
+		return nil
+	}
+	for _, r := range resources {
+		r.Name += suffix
+	}
+
+	_, err = w.Client.Collector().SetProjectUsage(ctx, &api.CollectorSetProjectUsage{
+		Location:  w.Location,
+		ProjectID: p.ID,
+		At:        at,
+		Resources: resources,
+	})
+	if err != nil {
+		slog.Error("collector: set project usage error", "error", err)
+		return nil
+	}
+	return resources
+}
+
+// builtinResources are the names of the project and deployment usage
+// resources other than extended resources, for every memory billing policy.
+var builtinResources = []string{
+	"cpu_usage", "cpu", "cpu_limit", "cpu_overage", "cpu_throttled",
+	"memory", "memory_request", "memory_usage", "memory_limit", "memory_overage",
+	"egress", "ingress", "disk", "ephemeral_storage_usage", "replica", "snapshot",
+	"requests", "requests_2xx", "requests_4xx", "requests_5xx", "latency_p95", "latency_p99",
+	"oom_kills", "restarts",
+}
+
+// validExtendedResources checks extended resources are unique and do not
+// collide with a built-in resource once converted to their resource name,
+// e.g. cpu or memory.
+func validExtendedResources(rs []string) error {
+	seen := make(map[string]string)
+	for _, r := range rs {
+		name := prom.ResourceName(r)
+		if slices.Contains(builtinResources, name) {
+			return fmt.Errorf("extended resource %q collides with built-in resource %s", r, name)
+		}
+		if x, ok := seen[name]; ok {
+			return fmt.Errorf("extended resources %q and %q are both %s", x, r, name)
+		}
+		seen[name] = r
+	}
+	return nil
+}
+
+type projectSummary struct {
+	Name string
+	F    func(ctx context.Context, projectID int64, start, end time.Time) (float64, error)
+}
+
+func (w *Worker) projectSummaries(p *api.CollectorProject) []projectSummary {
+	ss := []projectSummary{
+		{"cpu_usage", w.PromClient.SummaryCPUUsage},
+		{"cpu", w.PromClient.SummaryCPU},
+		{"cpu_overage", w.PromClient.SummaryCPUOverage},
+	}
+	ss = append(ss, w.memorySummaries(p)...)
+	ss = append(ss, []projectSummary{
+		{"egress", w.PromClient.SummaryEgress},
+		{"ingress", w.PromClient.SummaryIngress},
+		{"disk", w.PromClient.SummaryDisk},
+		{"ephemeral_storage_usage", w.PromClient.SummaryEphemeralStorageUsage},
+		{"replica", w.PromClient.SummaryReplica},
+	}...)
+	if w.PromClient.SnapshotMetric != "" {
+		ss = append(ss, projectSummary{"snapshot", w.PromClient.SummarySnapshot})
+	}
+	for _, r := range w.ExtendedResources {
+		ss = append(ss, projectSummary{
+			prom.ResourceName(r),
+			func(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+				return w.PromClient.SummaryResourceRequests(ctx, r, projectID, start, end)
+			},
+		})
+	}
+	return ss
+}
+
+// projectUsageResources computes all project usage resources over [start, end].
+func (w *Worker) projectUsageResources(ctx context.Context, p *api.CollectorProject, start, end time.Time) ([]*api.CollectorProjectUsageResource, error) {
+	var resources []*api.CollectorProjectUsageResource
+	for _, s := range w.projectSummaries(p) {
+		value, err := s.F(ctx, p.ID, start, end)
+		if err != nil {
+			slog.Error("collector: get prom summary error", "resource", s.Name, "project", p.ID, "error", err)
+			return nil, err
+		}
+		slog.Info("collector: projectUsageResources", "resource", s.Name, "project", p.ID, "start", start, "end", end, "value", value)
+		resources = append(resources, &api.CollectorProjectUsageResource{
+			Name:  s.Name,
+			Value: strconv.FormatFloat(value, 'f', -1, 64),
+		})
+	}
+	return resources, nil
+}
+
+// verifyNetwork logs the difference between the network resources
+// and the former max - min computation.
+func (w *Worker) verifyNetwork(ctx context.Context, p *api.CollectorProject, start, end time.Time, resources []*api.CollectorProjectUsageResource) {
+	legacy := []projectSummary{
+		{"egress", w.PromClient.SummaryEgressMaxMin},
+		{"ingress", w.PromClient.SummaryIngressMaxMin},
+	}
+	for _, s := range legacy {
+		var value float64
+		for _, r := range resources {
+			if r.Name == s.Name {
+				value, _ = strconv.ParseFloat(r.Value, 64)
+			}
+		}
+
+		old, err := s.F(ctx, p.ID, start, end)
+		if err != nil {
+			slog.Error("collector: verify network error", "resource", s.Name, "project", p.ID, "error", err)
+			continue
+		}
+
+		var ratio float64
+		if old != 0 {
+			ratio = value / old
+		}
+		slog.Info("collector: verify network", "resource", s.Name, "project", p.ID, "start", start, "old", old, "new", value, "diff", value-old, "ratio", ratio)
+	}
+}
+
+type deploymentSummary struct {
+	Name string
+	F    func(ctx context.Context, projectID int64, start, end time.Time) ([]*prom.PodVector, error)
+}
+
+// deploymentUsageResources computes usage resources of each deployment of the
+// project over [start, end], named "deployment/<deployment>/<resource>".
+func (w *Worker) deploymentUsageResources(ctx context.Context, p *api.CollectorProject, start, end time.Time) ([]*api.CollectorProjectUsageResource, error) {
+	summaries := []deploymentSummary{
+		{"cpu_usage", w.PromClient.SummaryCPUUsageByPod},
+		{"cpu", w.PromClient.SummaryCPUByPod},
+	}
+	summaries = append(summaries, w.deploymentMemorySummaries(p)...)
+
+	var resources []*api.CollectorProjectUsageResource
+	for _, s := range summaries {
+		vs, err := s.F(ctx, p.ID, start, end)
+		if err != nil {
+			slog.Error("collector: get prom deployment summary error", "resource", s.Name, "project", p.ID, "error", err)
+			return nil, err
+		}
+
+		values := make(map[string]float64)
+		for _, v := range vs {
+			a, reason := attributePod(v)
+			if reason == "" && a.ProjectID != p.ID {
+				reason = reasonUnknownProject
+			}
+			if reason != "" {
+				w.unattributed("project", s.Name, v.Pod, reason)
+				continue
+			}
+			values[a.Name] += v.Value
+		}
+		resources = append(resources, deploymentResources(s.Name, values)...)
+	}
+
+	// replica counts deployments, not pods, the same as the project replica
+	vs, err := w.PromClient.SummaryReplicaByDeployment(ctx, p.ID, start, end)
+	if err != nil {
+		slog.Error("collector: get prom deployment summary error", "resource", "replica", "project", p.ID, "error", err)
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for _, v := range vs {
+		a, reason := attributeDeployment(v)
+		if reason == "" && a.ProjectID != p.ID {
+			reason = reasonUnknownProject
+		}
+		if reason != "" {
+			w.unattributed("project", "replica", v.Deployment, reason)
+			continue
+		}
+		values[a.Name] += v.Value
+	}
+	resources = append(resources, deploymentResources("replica", values)...)
+
+	return resources, nil
+}
+
+// deploymentResources returns the resource of each deployment in values,
+// sorted by deployment name.
+func deploymentResources(resource string, values map[string]float64) []*api.CollectorProjectUsageResource {
+	var resources []*api.CollectorProjectUsageResource
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		resources = append(resources, &api.CollectorProjectUsageResource{
+			Name:  "deployment/" + name + "/" + resource,
+			Value: strconv.FormatFloat(values[name], 'f', -1, 64),
+		})
+	}
+	return resources
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidExtendedResources(t *testing.T) {
+	cases := []struct {
+		Resources []string
+		OK        bool
+	}{
+		{nil, true},
+		{[]string{"nvidia.com/gpu"}, true},
+		{[]string{"nvidia.com/gpu", "amd.com/gpu"}, true},
+		{[]string{"cpu"}, false},
+		{[]string{"memory"}, false},
+		{[]string{"nvidia.com/gpu", "nvidia.com/gpu"}, false},
+		{[]string{"nvidia.com/gpu", "nvidia_com/gpu"}, false},
+		{[]string{"cpu-usage"}, false},
+	}
+
+	for _, c := range cases {
+		err := validExtendedResources(c.Resources)
+		if (err == nil) != c.OK {
+			t.Errorf("validExtendedResources(%q) = %v, want ok %v", c.Resources, err, c.OK)
+		}
+	}
+}
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestTruncateHour(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+
+	cases := []struct {
+		In   time.Time
+		Want time.Time
+	}{
+		{time.Date(2026, 10, 18, 13, 45, 12, 500, time.UTC), time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC), time.Date(2026, 10, 18, 13, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 18, 13, 15, 0, 0, kolkata), time.Date(2026, 10, 18, 13, 0, 0, 0, kolkata)},
+		// second 01:00 of the fall-back day, 06:00 UTC
+		{time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC).In(ny), time.Date(2026, 11, 1, 6, 0, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		if got := truncateHour(c.In); !got.Equal(c.Want) {
+			t.Errorf("truncateHour(%v) = %v, want %v", c.In, got, c.Want)
+		}
+	}
+}
+
+func TestBillingDay(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+
+	cases := []struct {
+		Now    time.Time
+		Start  string
+		Length time.Duration
+	}{
+		{time.Date(2026, 10, 18, 13, 0, 0, 0, ny), "2026-10-18T00:00:00-04:00", 24 * time.Hour},
+		{time.Date(2026, 3, 8, 13, 0, 0, 0, ny), "2026-03-08T00:00:00-05:00", 23 * time.Hour},
+		{time.Date(2026, 11, 1, 13, 0, 0, 0, ny), "2026-11-01T00:00:00-04:00", 25 * time.Hour},
+		{time.Date(2026, 11, 1, 23, 59, 0, 0, ny), "2026-11-01T00:00:00-04:00", 25 * time.Hour},
+	}
+
+	for _, c := range cases {
+		start := billingDay(c.Now)
+		if got := start.Format(time.RFC3339); got != c.Start {
+			t.Errorf("billingDay(%v) = %s, want %s", c.Now, got, c.Start)
+		}
+		if got := start.AddDate(0, 0, 1).Sub(start); got != c.Length {
+			t.Errorf("billingDay(%v) length = %v, want %v", c.Now, got, c.Length)
+		}
+	}
+}
+
+func TestRecomputeYesterday(t *testing.T) {
+	bangkok := mustLoadLocation(t, "Asia/Bangkok")
+
+	cases := []struct {
+		Now  time.Time
+		Want bool
+	}{
+		{time.Date(2026, 10, 18, 0, 0, 0, 0, bangkok), true},
+		{time.Date(2026, 10, 18, 5, 59, 59, 0, bangkok), true},
+		{time.Date(2026, 10, 18, 6, 0, 0, 0, bangkok), false},
+		{time.Date(2026, 10, 18, 23, 0, 0, 0, bangkok), false},
+		// 23:00 UTC is 06:00 in Bangkok
+		{time.Date(2026, 10, 17, 23, 0, 0, 0, time.UTC).In(bangkok), false},
+	}
+
+	for _, c := range cases {
+		if got := recomputeYesterday(c.Now); got != c.Want {
+			t.Errorf("recomputeYesterday(%v) = %v, want %v", c.Now, got, c.Want)
+		}
+	}
+}
+
+func TestUsageBucketAt(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	bangkok := mustLoadLocation(t, "Asia/Bangkok")
+
+	cases := []struct {
+		Start time.Time
+		Want  string
+	}{
+		{time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC), "2026-10-18T00:00:00Z"},
+		{time.Date(2026, 10, 18, 0, 0, 0, 0, bangkok), "2026-10-18T00:00:00Z"},
+		{time.Date(2026, 10, 18, 0, 0, 0, 0, ny), "2026-10-18T00:00:00Z"},
+		{time.Date(2026, 11, 1, 0, 0, 0, 0, ny), "2026-11-01T00:00:00Z"},
+	}
+
+	for _, c := range cases {
+		if got := usageDate(c.Start); got != c.Want {
+			t.Errorf("usageDate(%v) = %s, want %s", c.Start, got, c.Want)
+		}
+	}
+
+	// both 01:00 hours of the fall-back day are separate buckets
+	first := time.Date(2026, 11, 1, 1, 0, 0, 0, ny)
+	second := first.Add(time.Hour)
+	if first.Hour() != 1 || second.Hour() != 1 {
+		t.Fatalf("hours = %d, %d, want 1, 1", first.Hour(), second.Hour())
+	}
+	if a, b := usageHour(first), usageHour(second); a != "2026-11-01T05:00:00Z" || b != "2026-11-01T06:00:00Z" {
+		t.Errorf("usageHour = %s, %s, want 2026-11-01T05:00:00Z, 2026-11-01T06:00:00Z", a, b)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/deploys-app/api"
+)
+
+// projectCache caches the active projects of the location.
+type projectCache struct {
+	mu        sync.Mutex
+	ids       map[int64]struct{}
+	updatedAt time.Time
+}
+
+func (c *projectCache) set(ps []*api.CollectorProject) {
+	ids := make(map[int64]struct{}, len(ps))
+	for _, p := range ps {
+		ids[p.ID] = struct{}{}
+	}
+
+	c.mu.Lock()
+	c.ids = ids
+	c.updatedAt = time.Now()
+	c.mu.Unlock()
+}
+
+// activeProjects returns the active project ids of the location,
+// refreshed from the api when older than ProjectRefreshInterval.
+// It returns nil if projects were never loaded.
+func (w *Worker) activeProjects(ctx context.Context) map[int64]struct{} {
+	w.projects.mu.Lock()
+	ids, updatedAt := w.projects.ids, w.projects.updatedAt
+	w.projects.mu.Unlock()
+
+	if ids != nil && time.Since(updatedAt) < w.ProjectRefreshInterval {
+		return ids
+	}
+
+	l, err := w.Client.Collector().Location(ctx, &api.CollectorLocation{Location: w.Location})
+	if err != nil {
+		slog.Error("collector: refresh location projects", "error", err)
+		return ids
+	}
+	w.projects.set(l.Projects)
+
+	w.projects.mu.Lock()
+	defer w.projects.mu.Unlock()
+	return w.projects.ids
+}
@@ -0,0 +1,103 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// History functions return the series of every pod or service in the
+// namespace over [start, end] at step, for analysis over a longer period.
+
+// PodSeries is a range query series of a pod or service,
+// its vector holds the attribution without value.
+type PodSeries struct {
+	PodVector
+	Series
+}
+
+func (c *Client) podSeries(ss []*Series) []*PodSeries {
+	rs := make([]*PodSeries, 0, len(ss))
+	for _, s := range ss {
+		v := c.podVector(s.Labels)
+		if v == nil {
+			continue
+		}
+		rs = append(rs, &PodSeries{
+			PodVector: *v,
+			Series:    *s,
+		})
+	}
+	return rs
+}
+
+func (c *Client) queryPodSeries(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	ss, err := c.QueryRange(ctx, c.withLabels(objectPod, "", query), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	return c.podSeries(ss), nil
+}
+
+// historyWindow returns the rate window for a range query at step,
+// long enough to not skip samples between steps.
+func (c *Client) historyWindow(step time.Duration) string {
+	return promDuration(max(step, c.rateWindow()))
+}
+
+// HistoryCPUUsage returns the cpu usage of each pod, in cores.
+func (c *Client) HistoryCPUUsage(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.queryPodSeries(ctx, fmt.Sprintf(
+		`sum by (namespace, pod) (rate(container_cpu_usage_seconds_total{namespace="%s",name=""}[%s]))`,
+		c.Namespace, c.historyWindow(step),
+	), start, end, step)
+}
+
+// HistoryRequests returns the request rate of each service, in requests per second.
+func (c *Client) HistoryRequests(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	ss, err := c.QueryRange(ctx, fmt.Sprintf(
+		`sum(rate(parapet_requests{ingress_namespace="%s"}[%s])) by (service_name)`,
+		c.Namespace, c.historyWindow(step),
+	), start, end, step)
+	if err != nil {
+		return nil, err
+	}
+	return c.podSeries(ss), nil
+}
+
+// historyResource returns the sum of container resource values of metric
+// for resource of each pod.
+func (c *Client) historyResource(ctx context.Context, metric, resource string, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.queryPodSeries(ctx, fmt.Sprintf(
+		`sum by (namespace, pod) (%s{namespace="%s",resource="%s"})`,
+		metric, c.Namespace, resource,
+	), start, end, step)
+}
+
+// HistoryCPU returns the cpu requests of each pod, in cores.
+func (c *Client) HistoryCPU(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.historyResource(ctx, "kube_pod_container_resource_requests", "cpu", start, end, step)
+}
+
+// HistoryCPULimit returns the cpu limits of each pod, in cores.
+func (c *Client) HistoryCPULimit(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.historyResource(ctx, "kube_pod_container_resource_limits", "cpu", start, end, step)
+}
+
+// HistoryMemoryUsage returns the memory working set of each pod, in bytes.
+func (c *Client) HistoryMemoryUsage(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.queryPodSeries(ctx, fmt.Sprintf(
+		`sum by (namespace, pod) (container_memory_working_set_bytes{namespace="%s",name=""})`,
+		c.Namespace,
+	), start, end, step)
+}
+
+// HistoryMemory returns the memory requests of each pod, in bytes.
+func (c *Client) HistoryMemory(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.historyResource(ctx, "kube_pod_container_resource_requests", "memory", start, end, step)
+}
+
+// HistoryMemoryLimit returns the memory limits of each pod, in bytes.
+func (c *Client) HistoryMemoryLimit(ctx context.Context, start, end time.Time, step time.Duration) ([]*PodSeries, error) {
+	return c.historyResource(ctx, "kube_pod_container_resource_limits", "memory", start, end, step)
+}
@@ -0,0 +1,181 @@
+package prom
+
+import (
+	"fmt"
+	"strings"
+)
+
+// object is a kubernetes object kind that series are attributed through.
+type object struct {
+	Table string // kube-state-metrics labels metric
+	Key   string // label holding the object name
+	Name  string // fallback name regex, %d is the project id
+
+	// Patterns, if set, attribute names matching Name by the first
+	// matching pattern, the project id is its second group.
+	Patterns []string
+
+	// Source, if set, is the label holding the object name in the
+	// selectors of a query, when Key is only set on its result.
+	Source string
+}
+
+// source returns the label holding the object name in selectors.
+func (o object) source() string {
+	if o.Source != "" {
+		return o.Source
+	}
+	return o.Key
+}
+
+var (
+	objectPod        = object{Table: "kube_pod_labels", Key: "pod", Name: `.*-%d-.*`, Patterns: PodNamePatterns}
+	objectDeployment = object{Table: "kube_deployment_labels", Key: "deployment", Name: `.*-%d$`}
+	objectVolume     = object{Table: "kube_persistentvolumeclaim_labels", Key: "persistentvolumeclaim", Name: `.*-%d$`}
+)
+
+// pod name suffixes are generated from kubernetes' safe encoding alphabet
+const safeChars = `[bcdfghjklmnpqrstvwxz2456789]`
+
+// Pod naming schemes of workload controllers, the first group is
+// the workload name and the second the project id.
+const (
+	// <name>-<project>-<scheduled unix minutes>-<suffix>
+	CronJobPodName = `^(.+)-(\d+)-\d{8,}-` + safeChars + `{5}$`
+	// <name>-<project>-<pod template hash>-<suffix>
+	DeploymentPodName = `^(.+)-(\d+)-` + safeChars + `{6,10}-` + safeChars + `{5}$`
+	// <name>-<project>-<ordinal>
+	StatefulSetPodName = `^(.+)-(\d+)-(?:0|[1-9]\d{0,3})$`
+	// <name>-<project>-<suffix>
+	JobPodName = `^(.+)-(\d+)-` + safeChars + `{5}$`
+	// <name>-<project>-<any>-<any>, for names of no known controller
+	LoosePodName = `^(.+)-(\d+)-[^-]+-[^-]+$`
+)
+
+// PodNamePatterns are the pod naming schemes in the order they are tried,
+// the first match wins.
+var PodNamePatterns = []string{
+	CronJobPodName,
+	DeploymentPodName,
+	StatefulSetPodName,
+	JobPodName,
+	LoosePodName,
+}
+
+// nameProjectLabel is the temporary label holding the project id
+// parsed from an object name.
+const nameProjectLabel = "collector_name_project"
+
+// sanitizeName replaces characters not valid in a prometheus label name with _.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// labelName converts a kubernetes label key to its kube-state-metrics
+// label name, e.g. "deploys.app/project" to "label_deploys_app_project".
+func labelName(key string) string {
+	return "label_" + sanitizeName(key)
+}
+
+// ResourceName converts a kubernetes resource name to its kube-state-metrics
+// resource label value, e.g. "nvidia.com/gpu" to "nvidia_com_gpu".
+func ResourceName(name string) string {
+	return sanitizeName(name)
+}
+
+func (c *Client) projectLabel() string {
+	if c.ProjectLabel == "" {
+		return ""
+	}
+	return labelName(c.ProjectLabel)
+}
+
+func (c *Client) nameLabel() string {
+	if c.NameLabel == "" {
+		return ""
+	}
+	return labelName(c.NameLabel)
+}
+
+// withLabels joins the attribution labels of o into every series of query.
+// Series without a labels metric are kept as is.
+// If window is not empty, labels are looked up over the window
+// to include objects that are already gone at evaluation time.
+func (c *Client) withLabels(o object, window, query string) string {
+	lp := c.projectLabel()
+	if lp == "" {
+		return query
+	}
+
+	labels := lp
+	if ln := c.nameLabel(); ln != "" && ln != lp {
+		labels += ", " + ln
+	}
+	table := fmt.Sprintf(`%s{namespace="%s"}`, o.Table, c.Namespace)
+	if window != "" {
+		table = fmt.Sprintf(`max_over_time(%s[%s])`, table, window)
+	}
+	return fmt.Sprintf(
+		`((%[1]s) * on (namespace, %[2]s) group_left (%[3]s) max by (namespace, %[2]s, %[3]s) (%[4]s)) or on (namespace, %[2]s) (%[1]s)`,
+		query, o.Key, labels, table,
+	)
+}
+
+// projectSelect returns series of f that belong to projectID.
+// f receives a label matcher on the object name, on the source label of o,
+// to put in its selectors.
+//
+// When ProjectLabel is set, series are matched through the project label of o,
+// objects without the label fall back to name matching.
+// If window is not empty, labels are looked up over the window
+// to include objects that are already gone at evaluation time.
+func (c *Client) projectSelect(o object, projectID int64, window string, f func(matcher string) string) string {
+	fallback := c.nameSelect(o, projectID, f)
+
+	lp := c.projectLabel()
+	if lp == "" {
+		return fallback
+	}
+
+	table := func(matcher string) string {
+		s := fmt.Sprintf(`%s{namespace="%s",%s}`, o.Table, c.Namespace, matcher)
+		if window != "" {
+			s = fmt.Sprintf(`max_over_time(%s[%s])`, s, window)
+		}
+		return fmt.Sprintf(`max by (namespace, %s) (%s)`, o.Key, s)
+	}
+
+	return fmt.Sprintf(
+		`((%[1]s) * on (namespace, %[2]s) group_left () %[3]s or ((%[4]s) unless on (namespace, %[2]s) %[5]s))`,
+		f(fmt.Sprintf(`%s!=""`, o.source())), o.Key,
+		table(fmt.Sprintf(`%s="%d"`, lp, projectID)),
+		fallback,
+		table(fmt.Sprintf(`%s!=""`, lp)),
+	)
+}
+
+// nameSelect returns series of f whose object name belongs to projectID.
+//
+// Names are first selected by the Name regex of o. If o has Patterns,
+// every pattern writes the project id it parses to a temporary label,
+// the highest priority last, so the label holds the project id
+// of the first matching pattern, the same as the collector attributes names.
+func (c *Client) nameSelect(o object, projectID int64, f func(matcher string) string) string {
+	q := f(fmt.Sprintf(`%s=~"%s"`, o.source(), fmt.Sprintf(o.Name, projectID)))
+	if len(o.Patterns) == 0 {
+		return q
+	}
+
+	for i := len(o.Patterns) - 1; i >= 0; i-- {
+		q = fmt.Sprintf("label_replace(%s, \"%s\", \"$2\", \"%s\", `%s`)", q, nameProjectLabel, o.Key, o.Patterns[i])
+	}
+	return fmt.Sprintf(
+		`label_replace(%[1]s and on (%[2]s) label_replace(vector(1), "%[2]s", "%[3]d", "", ""), "%[2]s", "", "", "")`,
+		q, nameProjectLabel, projectID,
+	)
+}
@@ -0,0 +1,63 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Per pod summaries return the value of each pod of a project over
+// [start, end] with attribution labels joined, the same as their
+// project summary before summing across pods.
+
+func (c *Client) summaryPods(ctx context.Context, query string, start, end time.Time, mode integralMode) ([]*PodVector, error) {
+	ss, err := c.integralSamples(ctx, c.withLabels(objectPod, "", query), start, end, mode)
+	if err != nil {
+		return nil, err
+	}
+	return c.podVectors(ss), nil
+}
+
+func (c *Client) SummaryCPUUsageByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	if !end.After(start) {
+		return nil, nil
+	}
+
+	window := promDuration(end.Sub(start))
+	q := make(url.Values)
+	q.Set("query", c.withLabels(objectPod, window, c.podCPUUsage(projectID, window)))
+	q.Set("time", strconv.FormatInt(end.Unix(), 10))
+
+	ss, err := c.queryVector(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return c.podVectors(ss), nil
+}
+
+func (c *Client) SummaryCPUByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	return c.summaryPods(ctx, c.podRequests("cpu", projectID), start, end, integralStep)
+}
+
+func (c *Client) SummaryMemoryByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	return c.summaryPods(ctx, c.podMemory(projectID), start, end, integralTrapezoid)
+}
+
+func (c *Client) SummaryMemoryRequestByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	return c.summaryPods(ctx, c.podRequests("memory", projectID), start, end, integralStep)
+}
+
+func (c *Client) SummaryMemoryUsageByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	return c.summaryPods(ctx, c.podMemoryUsage(projectID), start, end, integralTrapezoid)
+}
+
+// SummaryMemoryOverageByPod returns working set byte-seconds above requests
+// of each pod, pods without requests are all overage.
+func (c *Client) SummaryMemoryOverageByPod(ctx context.Context, projectID int64, start, end time.Time) ([]*PodVector, error) {
+	return c.summaryPods(ctx, fmt.Sprintf(
+		`clamp_min((%[1]s - %[2]s) or %[1]s, 0)`,
+		c.podMemoryUsage(projectID), c.podRequests("memory", projectID),
+	), start, end, integralTrapezoid)
+}
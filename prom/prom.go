@@ -2,18 +2,70 @@ package prom
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
+)
+
+var (
+	ErrInvalidValue   = errors.New("prom: invalid sample value")
+	ErrNonFiniteValue = errors.New("prom: non-finite sample value")
 )
 
 type Client struct {
 	Endpoint   string
 	Namespace  string
 	HTTPClient *http.Client
+
+	// Step is the resolution of range queries used to integrate usage,
+	// default to 1 minute.
+	Step time.Duration
+
+	// ProjectLabel and NameLabel are the kubernetes label keys holding
+	// the project id and the deployment or disk name.
+	// When ProjectLabel is empty, series are attributed by object name only.
+	ProjectLabel string
+	NameLabel    string
+
+	// LatencyMetric is the parapet request duration histogram,
+	// default to parapet_request_duration_seconds.
+	LatencyMetric string
+
+	// DiskIOMetrics are the per volume disk io counters.
+	DiskIOMetrics DiskIOMetrics
+
+	// SnapshotMetric is the volume snapshot size in bytes, labeled with
+	// namespace and the source volume in SnapshotSourceLabel
+	// (default to source_persistentvolumeclaim).
+	SnapshotMetric      string
+	SnapshotSourceLabel string
+
+	// OnNonFinite is called with the query and the number of samples
+	// dropped for a non-finite value (NaN, ±Inf), if set.
+	OnNonFinite func(query string, dropped int)
+}
+
+// DiskIOMetrics are names of counters labeled with namespace and
+// persistentvolumeclaim, there is no standard source so they depend
+// on the storage driver.
+type DiskIOMetrics struct {
+	ReadOps    string
+	WriteOps   string
+	ReadBytes  string
+	WriteBytes string
+}
+
+func (c *Client) nonFinite(query string, dropped int) {
+	if dropped > 0 && c.OnNonFinite != nil {
+		c.OnNonFinite(query, dropped)
+	}
 }
 
 func (c *Client) httpClient() *http.Client {
@@ -23,8 +75,48 @@ func (c *Client) httpClient() *http.Client {
 	return http.DefaultClient
 }
 
-func (c *Client) do(path string) ([]byte, error) {
-	req, err := http.NewRequest(http.MethodGet, c.Endpoint+path, nil)
+func (c *Client) latencyMetric() string {
+	if c.LatencyMetric != "" {
+		return c.LatencyMetric
+	}
+	return "parapet_request_duration_seconds"
+}
+
+func (c *Client) snapshotSourceLabel() string {
+	if c.SnapshotSourceLabel != "" {
+		return c.SnapshotSourceLabel
+	}
+	return "source_persistentvolumeclaim"
+}
+
+// snapshotSize returns the snapshot size selector with matcher on its source
+// volume, the source is copied to persistentvolumeclaim for attribution.
+func (c *Client) snapshotSize(matcher string) string {
+	src := c.snapshotSourceLabel()
+	if matcher != "" {
+		matcher = "," + matcher
+	}
+	return fmt.Sprintf(
+		`label_replace(%s{namespace="%s"%s}, "persistentvolumeclaim", "$1", "%s", "(.+)")`,
+		c.SnapshotMetric, c.Namespace, matcher, src,
+	)
+}
+
+func (c *Client) step() time.Duration {
+	if c.Step > 0 {
+		return c.Step
+	}
+	return time.Minute
+}
+
+// rateWindow is the rate range used in range queries,
+// it covers the step so no samples are skipped between steps.
+func (c *Client) rateWindow() time.Duration {
+	return max(c.step(), time.Minute)
+}
+
+func (c *Client) do(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.Endpoint+path, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -44,53 +136,40 @@ func (c *Client) do(path string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-func (c *Client) queryVectorValue(q url.Values) (string, error) {
-	resp, err := c.do("/api/v1/query?" + q.Encode())
-	if err != nil {
-		return "", err
-	}
-	var p struct {
-		Status string
-		Data   struct {
-			ResultType string
-			Result     []struct {
-				Value []any
-			}
-		}
-	}
-	err = json.Unmarshal(resp, &p)
-	if err != nil {
-		return "", err
+// parseSample parses a prometheus [ <unix_time>, "<value>" ] pair.
+// Non-finite values (NaN, ±Inf) are reported with ErrNonFiniteValue.
+func parseSample(v []any) (time.Time, float64, error) {
+	if len(v) != 2 {
+		return time.Time{}, 0, fmt.Errorf("%w: sample length not equal to 2", ErrInvalidValue)
 	}
 
-	if p.Status != "success" {
-		return "", fmt.Errorf("status not success")
+	ts, ok := v[0].(float64)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("%w: can not cast timestamp to number", ErrInvalidValue)
 	}
+	t := time.UnixMilli(int64(math.Round(ts * 1000)))
 
-	if len(p.Data.Result) != 1 {
-		return "", fmt.Errorf("result data length not equal to 1")
+	s, ok := v[1].(string)
+	if !ok {
+		return t, 0, fmt.Errorf("%w: can not cast value to string", ErrInvalidValue)
 	}
-
-	if len(p.Data.Result[0].Value) != 2 {
-		return "", fmt.Errorf("result data at index 0 value length not equal to 2")
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return t, 0, fmt.Errorf("%w: %q", ErrInvalidValue, s)
 	}
-
-	s, ok := p.Data.Result[0].Value[1].(string)
-	if !ok {
-		return "", fmt.Errorf("can not cast result data to string")
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return t, f, fmt.Errorf("%w: %q", ErrNonFiniteValue, s)
 	}
-	return s, nil
+	return t, f, nil
 }
 
-type PodVector struct {
-	Pod     string
-	Service string
-	Time    int64
-	Value   string
+type vectorResult struct {
+	Metric map[string]string
+	Value  []any
 }
 
-func (c *Client) queryPodVectors(q url.Values) ([]*PodVector, error) {
-	resp, err := c.do("/api/v1/query?" + q.Encode())
+func (c *Client) query(ctx context.Context, q url.Values) ([]*vectorResult, error) {
+	resp, err := c.do(ctx, "/api/v1/query?"+q.Encode())
 	if err != nil {
 		return nil, err
 	}
@@ -98,10 +177,7 @@ func (c *Client) queryPodVectors(q url.Values) ([]*PodVector, error) {
 		Status string
 		Data   struct {
 			ResultType string
-			Result     []*struct {
-				Metric map[string]string
-				Value  []any
-			}
+			Result     []*vectorResult
 		}
 	}
 	err = json.Unmarshal(resp, &p)
@@ -110,368 +186,729 @@ func (c *Client) queryPodVectors(q url.Values) ([]*PodVector, error) {
 	}
 
 	if p.Status != "success" {
-		return nil, fmt.Errorf("not ok")
+		return nil, fmt.Errorf("status not success")
+	}
+
+	return p.Data.Result, nil
+}
+
+func (c *Client) queryVectorValue(ctx context.Context, q url.Values) (float64, error) {
+	rs, err := c.query(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(rs) != 1 {
+		return 0, fmt.Errorf("result data length not equal to 1")
 	}
 
-	rs := p.Data.Result
+	_, f, err := parseSample(rs[0].Value)
+	if err != nil {
+		return 0, err
+	}
+	return f, nil
+}
 
-	vs := make([]*PodVector, 0, len(rs))
+// Sample is a single instant vector element with its full label set.
+type Sample struct {
+	Labels map[string]string
+	Time   time.Time
+	Value  float64
+}
+
+// Label returns the value of label name, or empty string if not set.
+func (s *Sample) Label(name string) string {
+	return s.Labels[name]
+}
+
+// queryVector runs an instant query and returns every sample in the result.
+// Samples with non-finite values are dropped and reported to OnNonFinite.
+func (c *Client) queryVector(ctx context.Context, q url.Values) ([]*Sample, error) {
+	rs, err := c.query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var dropped int
+	defer func() { c.nonFinite(q.Get("query"), dropped) }()
+
+	ss := make([]*Sample, 0, len(rs))
 	for _, x := range rs {
-		pod := x.Metric["pod"]
-		service := x.Metric["service_name"]
-		if len(x.Value) != 2 {
+		t, f, err := parseSample(x.Value)
+		if errors.Is(err, ErrNonFiniteValue) {
+			dropped++
 			continue
 		}
-		if pod == "" && service == "" {
-			continue
+		if err != nil {
+			return nil, err
 		}
 
-		vs = append(vs, &PodVector{
-			Pod:     pod,
-			Service: service,
-			Time:    int64(x.Value[0].(float64)),
-			Value:   x.Value[1].(string),
+		ss = append(ss, &Sample{
+			Labels: x.Metric,
+			Time:   t,
+			Value:  f,
 		})
 	}
 
-	return vs, nil
+	return ss, nil
 }
 
-type VolumeVector struct {
-	Volume string
-	Time   int64
-	Value  string
+// Query runs an instant query at the current time.
+func (c *Client) Query(ctx context.Context, query string) ([]*Sample, error) {
+	q := make(url.Values)
+	q.Set("query", query)
+
+	return c.queryVector(ctx, q)
 }
 
-func (c *Client) queryVolumeVectors(q url.Values) ([]*VolumeVector, error) {
-	resp, err := c.do("/api/v1/query?" + q.Encode())
-	if err != nil {
-		return nil, err
-	}
-	var p struct {
-		Status string
-		Data   struct {
-			ResultType string
-			Result     []*struct {
-				Metric map[string]string
-				Value  []any
-			}
+type PodVector struct {
+	Pod       string
+	Service   string
+	Container string
+	Labels    map[string]string
+	Time      time.Time
+	Value     float64
+
+	// Project and Deployment are the attribution label values,
+	// empty if the pod does not carry them.
+	Project    string
+	Deployment string
+}
+
+func (c *Client) podVectors(ss []*Sample) []*PodVector {
+	vs := make([]*PodVector, 0, len(ss))
+	for _, x := range ss {
+		v := c.podVector(x.Labels)
+		if v == nil {
+			continue
 		}
+		v.Time = x.Time
+		v.Value = x.Value
+		vs = append(vs, v)
 	}
-	err = json.Unmarshal(resp, &p)
+	return vs
+}
+
+// podVector returns the pod vector of a series with labels, without value,
+// or nil if the series has no pod nor service.
+func (c *Client) podVector(labels map[string]string) *PodVector {
+	pod := labels["pod"]
+	service := labels["service_name"]
+	if pod == "" && service == "" {
+		return nil
+	}
+
+	v := PodVector{
+		Pod:       pod,
+		Service:   service,
+		Container: labels["container"],
+		Labels:    labels,
+	}
+	if lp := c.projectLabel(); lp != "" {
+		v.Project = labels[lp]
+	}
+	if ln := c.nameLabel(); ln != "" {
+		v.Deployment = labels[ln]
+	}
+	return &v
+}
+
+// queryPodVectors runs a per pod instant query with attribution labels joined.
+func (c *Client) queryPodVectors(ctx context.Context, query string) ([]*PodVector, error) {
+	ss, err := c.Query(ctx, c.withLabels(objectPod, "", query))
 	if err != nil {
 		return nil, err
 	}
+	return c.podVectors(ss), nil
+}
 
-	if p.Status != "success" {
-		return nil, fmt.Errorf("not ok")
+// queryServiceVectors runs a per service instant query,
+// services have no labels metric so they are attributed by name only.
+func (c *Client) queryServiceVectors(ctx context.Context, query string) ([]*PodVector, error) {
+	ss, err := c.Query(ctx, query)
+	if err != nil {
+		return nil, err
 	}
+	return c.podVectors(ss), nil
+}
+
+type VolumeVector struct {
+	Volume string
+	Labels map[string]string
+	Time   time.Time
+	Value  float64
+
+	// Project and Disk are the attribution label values,
+	// empty if the volume does not carry them.
+	Project string
+	Disk    string
+}
 
-	rs := p.Data.Result
+func (c *Client) volumeVectors(ss []*Sample, label string) []*VolumeVector {
+	lp, ln := c.projectLabel(), c.nameLabel()
 
-	vs := make([]*VolumeVector, 0, len(rs))
-	for _, x := range rs {
-		volume := x.Metric["persistentvolumeclaim"]
-		if len(x.Value) != 2 {
-			continue
-		}
+	vs := make([]*VolumeVector, 0, len(ss))
+	for _, x := range ss {
+		volume := x.Label(label)
 		if volume == "" {
 			continue
 		}
 
-		vs = append(vs, &VolumeVector{
+		v := VolumeVector{
 			Volume: volume,
-			Time:   int64(x.Value[0].(float64)),
-			Value:  x.Value[1].(string),
-		})
+			Labels: x.Labels,
+			Time:   x.Time,
+			Value:  x.Value,
+		}
+		if lp != "" {
+			v.Project = x.Label(lp)
+		}
+		if ln != "" {
+			v.Disk = x.Label(ln)
+		}
+		vs = append(vs, &v)
 	}
-
-	return vs, nil
+	return vs
 }
 
-func (c *Client) queryMatrixValue(q url.Values) ([][]string, error) {
-	resp, err := c.do("/api/v1/query_range?" + q.Encode())
+// queryVolumeVectors runs a per volume instant query with attribution labels joined.
+func (c *Client) queryVolumeVectors(ctx context.Context, query string) ([]*VolumeVector, error) {
+	ss, err := c.Query(ctx, c.withLabels(objectVolume, "", query))
 	if err != nil {
 		return nil, err
 	}
-	var p struct {
-		Status string
-		Data   struct {
-			ResultType string
-			Result     []struct {
-				Values [][]any
-			}
+	return c.volumeVectors(ss, objectVolume.Key), nil
+}
+
+type DeploymentVector struct {
+	Deployment string
+	Labels     map[string]string
+	Time       time.Time
+	Value      float64
+
+	// Project and Name are the attribution label values,
+	// empty if the deployment does not carry them.
+	Project string
+	Name    string
+}
+
+func (c *Client) deploymentVectors(ss []*Sample) []*DeploymentVector {
+	lp, ln := c.projectLabel(), c.nameLabel()
+
+	vs := make([]*DeploymentVector, 0, len(ss))
+	for _, x := range ss {
+		deployment := x.Label(objectDeployment.Key)
+		if deployment == "" {
+			continue
 		}
+
+		v := DeploymentVector{
+			Deployment: deployment,
+			Labels:     x.Labels,
+			Time:       x.Time,
+			Value:      x.Value,
+		}
+		if lp != "" {
+			v.Project = x.Label(lp)
+		}
+		if ln != "" {
+			v.Name = x.Label(ln)
+		}
+		vs = append(vs, &v)
 	}
-	err = json.Unmarshal(resp, &p)
-	if err != nil {
-		return nil, err
+	return vs
+}
+
+// summaryAt runs query as an instant query at end,
+// range selectors in query should cover end - start.
+func (c *Client) summaryAt(ctx context.Context, query string, start, end time.Time) (float64, error) {
+	if !end.After(start) {
+		return 0, nil
 	}
 
-	if p.Status != "success" {
-		return nil, fmt.Errorf("not ok")
+	q := make(url.Values)
+	q.Set("query", query)
+	q.Set("time", strconv.FormatInt(end.Unix(), 10))
+
+	return c.queryVectorValue(ctx, q)
+}
+
+// podCPUUsage returns cpu-seconds used per pod over window.
+func (c *Client) podCPUUsage(projectID int64, window string) string {
+	return fmt.Sprintf(`sum by (namespace, pod) (%s)`, c.projectSelect(objectPod, projectID, window, func(m string) string {
+		return fmt.Sprintf(`increase(container_cpu_usage_seconds_total{namespace="%s",name="",%s}[%s])`, c.Namespace, m, window)
+	}))
+}
+
+func (c *Client) SummaryCPUUsage(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryAt(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.podCPUUsage(projectID, promDuration(end.Sub(start))),
+	), start, end)
+}
+
+// SummaryCPUOverage returns cpu-seconds used above requests over [start, end].
+// Overage is computed per pod at every step, so idle requests of one pod
+// do not offset the burst of another. Pods without requests are all overage.
+func (c *Client) SummaryCPUOverage(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	usage := fmt.Sprintf(`sum by (pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`rate(container_cpu_usage_seconds_total{namespace="%s",name="",%s}[%s])`, c.Namespace, m, promDuration(c.rateWindow()))
+	}))
+	requests := fmt.Sprintf(`sum by (pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`kube_pod_container_resource_requests{namespace="%s",resource="cpu",%s}`, c.Namespace, m)
+	}))
+	if !end.After(start) {
+		return 0, nil
 	}
 
-	if len(p.Data.Result) != 1 {
-		return nil, fmt.Errorf("not ok")
+	step := c.step()
+	us, err := c.QueryRange(ctx, usage, start, end, step)
+	if err != nil {
+		return 0, err
 	}
+	rs, err := c.QueryRange(ctx, requests, start, end, step)
+	if err != nil {
+		return 0, err
+	}
+	return overage(us, rs, step), nil
+}
 
-	var res [][]string
-	for _, vv := range p.Data.Result[0].Values {
-		if len(vv) != 2 {
-			continue
-		}
-		t, ok := vv[0].(float64)
-		if !ok {
-			continue
-		}
-		v, ok := vv[1].(string)
-		if !ok {
-			continue
+// overage integrates the usage above requests of each pod series,
+// points without requests are all overage.
+func overage(usage, requests []*Series, step time.Duration) float64 {
+	rs := make(map[string]map[time.Time]float64)
+	for _, s := range requests {
+		m := make(map[time.Time]float64, len(s.Points))
+		for _, p := range s.Points {
+			m[p.Time] = p.Value
 		}
+		rs[s.Label("pod")] = m
+	}
 
-		res = append(res, []string{
-			strconv.FormatFloat(t, 'f', 3, 64),
-			v,
-		})
+	var r float64
+	for _, s := range usage {
+		req := rs[s.Label("pod")]
+		o := Series{Points: make([]Point, 0, len(s.Points))}
+		for _, p := range s.Points {
+			o.Points = append(o.Points, Point{Time: p.Time, Value: max(p.Value-req[p.Time], 0)})
+		}
+		r += o.IntegrateTrapezoid(step)
 	}
+	return r
+}
 
-	return res, nil
+// podRequests returns requests of resource per pod.
+func (c *Client) podRequests(resource string, projectID int64) string {
+	return fmt.Sprintf(`sum by (namespace, pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`kube_pod_container_resource_requests{namespace="%s",resource="%s",%s}`, c.Namespace, resource, m)
+	}))
 }
 
-func (c *Client) SummaryCPUUsage(projectID int64, startTimeUnix int64, dataRange string, rangeSecond int64) (string, error) {
-	q := make(url.Values)
+// summaryRequests returns requested resource-seconds over [start, end].
+func (c *Client) summaryRequests(ctx context.Context, resource string, projectID int64, start, end time.Time) (float64, error) {
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.podRequests(resource, projectID),
+	), start, end, integralStep)
+}
 
-	q.Set("query", fmt.Sprintf(
-		// `
-		// 	clamp_min(
-		// 		sum(increase(container_cpu_usage_seconds_total{name="",namespace="%s",pod=~".*-%d-[^-]+-[^-]+$"}[%s]))
-		// 		- (sum(kube_pod_container_resource_requests{namespace="%s",resource="cpu",pod=~".*-%d-[^-]+-[^-]+$"}) * %d)
-		// 	, 0) or vector(0)`,
-		`sum(increase(container_cpu_usage_seconds_total{namespace="%s",name="",pod=~".*-%d-[^-]+-[^-]+$"}[%s])) or vector(0)`,
-		// c.Namespace, projectID, dataRange,
-		// c.Namespace, projectID, rangeSecond,
-		c.Namespace, projectID, dataRange,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
+// SummaryCPU returns requested cpu-seconds over [start, end].
+func (c *Client) SummaryCPU(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryRequests(ctx, "cpu", projectID, start, end)
+}
 
-	return c.queryVectorValue(q)
+// SummaryResourceRequests returns requested resource-seconds of an extended
+// resource over [start, end], resource is the kubernetes resource name.
+func (c *Client) SummaryResourceRequests(ctx context.Context, resource string, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryRequests(ctx, ResourceName(resource), projectID, start, end)
 }
 
-func (c *Client) SummaryCPU(projectID int64, startTimeUnix int64, dataRange string, rangeSecond int64) (string, error) {
-	q := make(url.Values)
+// podMemoryUsage returns the working set memory per pod.
+func (c *Client) podMemoryUsage(projectID int64) string {
+	return fmt.Sprintf(`sum by (namespace, pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`container_memory_working_set_bytes{namespace="%s",name="",%s}`, c.Namespace, m)
+	}))
+}
 
-	q.Set("query", fmt.Sprintf(
-		`(sum(avg_over_time(kube_pod_container_resource_requests{namespace="%s",resource="cpu",pod=~".*-%d-[^-]+-[^-]+$"}[%s])) or vector(0)) * %d`,
-		c.Namespace, projectID, dataRange, rangeSecond,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
+// podMemory returns max(requested, working_set) memory per pod.
+// label_replace tags each side so `or` keeps both and `max by (pod)`
+// picks the larger.
+func (c *Client) podMemory(projectID int64) string {
+	return fmt.Sprintf(
+		`max by (namespace, pod) (`+
+			`label_replace(sum by (namespace, pod) (%s), "kind", "u", "", "")`+
+			` or `+
+			`label_replace(sum by (namespace, pod) (%s), "kind", "r", "", "")`+
+			`)`,
+		c.projectSelect(objectPod, projectID, "", func(m string) string {
+			return fmt.Sprintf(`container_memory_working_set_bytes{namespace="%s",name="",%s}`, c.Namespace, m)
+		}),
+		c.projectSelect(objectPod, projectID, "", func(m string) string {
+			return fmt.Sprintf(`kube_pod_container_resource_requests{namespace="%s",resource="memory",%s}`, c.Namespace, m)
+		}),
+	)
+}
 
-	return c.queryVectorValue(q)
+func (c *Client) SummaryMemory(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	// Bill memory as max(requested, working_set) per pod, integrated over the range
+	// (byte-seconds); sum across pods at each step.
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.podMemory(projectID),
+	), start, end, integralTrapezoid)
 }
 
-func (c *Client) SummaryMemory(projectID int64, startTimeUnix int64, dataRange string, rangeSecond int64) (string, error) {
-	q := make(url.Values)
+// SummaryMemoryRequest returns requested memory byte-seconds over [start, end].
+func (c *Client) SummaryMemoryRequest(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryRequests(ctx, "memory", projectID, start, end)
+}
 
-	// Bill memory as max(requested, working_set) per pod, integrated over the range
-	// (byte-seconds). label_replace tags each side so `or` keeps both and `max by (pod)`
-	// picks the larger; sum across pods, scale by rangeSecond.
-	q.Set("query", fmt.Sprintf(
-		`(sum(max by (pod) (`+
-			`label_replace(sum by (pod) (avg_over_time(container_memory_working_set_bytes{namespace="%[1]s",name="",pod=~".*-%[2]d-[^-]+-[^-]+$"}[%[3]s])), "kind", "u", "", "")`+
-			` or `+
-			`label_replace(sum by (pod) (avg_over_time(kube_pod_container_resource_requests{namespace="%[1]s",resource="memory",pod=~".*-%[2]d-[^-]+-[^-]+$"}[%[3]s])), "kind", "r", "", "")`+
-			`)) or vector(0)) * %[4]d`,
-		c.Namespace, projectID, dataRange, rangeSecond,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
+// SummaryMemoryUsage returns working set byte-seconds over [start, end].
+func (c *Client) SummaryMemoryUsage(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.projectSelect(objectPod, projectID, "", func(m string) string {
+			return fmt.Sprintf(`container_memory_working_set_bytes{namespace="%s",name="",%s}`, c.Namespace, m)
+		}),
+	), start, end, integralTrapezoid)
+}
 
-	return c.queryVectorValue(q)
+// SummaryMemoryOverage returns working set byte-seconds above requests over [start, end].
+// Overage is computed per pod, pods without requests are all overage.
+func (c *Client) SummaryMemoryOverage(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	usage := fmt.Sprintf(`sum by (pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`container_memory_working_set_bytes{namespace="%s",name="",%s}`, c.Namespace, m)
+	}))
+	requests := fmt.Sprintf(`sum by (pod) (%s)`, c.projectSelect(objectPod, projectID, "", func(m string) string {
+		return fmt.Sprintf(`kube_pod_container_resource_requests{namespace="%s",resource="memory",%s}`, c.Namespace, m)
+	}))
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(clamp_min((%[1]s - %[2]s) or %[1]s, 0)) or vector(0)`,
+		usage, requests,
+	), start, end, integralTrapezoid)
 }
 
-func (c *Client) SummaryEgress(projectID int64, startTimeUnix int64, dataRange string) (string, error) {
-	q := make(url.Values)
+// SummaryEphemeralStorageUsage returns container filesystem byte-seconds over [start, end].
+func (c *Client) SummaryEphemeralStorageUsage(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.projectSelect(objectPod, projectID, "", func(m string) string {
+			return fmt.Sprintf(`container_fs_usage_bytes{namespace="%s",container!="",container!="POD",%s}`, c.Namespace, m)
+		}),
+	), start, end, integralTrapezoid)
+}
+
+// SummarySnapshot returns volume snapshot byte-seconds over [start, end].
+func (c *Client) SummarySnapshot(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	if c.SnapshotMetric == "" {
+		return 0, nil
+	}
+	// match on the source volume in selectors, the label is not copied yet
+	o := objectVolume
+	o.Source = c.snapshotSourceLabel()
+
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.projectSelect(o, projectID, "", c.snapshotSize),
+	), start, end, integralStep)
+}
+
+// summaryNetwork returns bytes counted by a pod network counter over [start, end].
+// increase is computed per series before summing, so counter resets and pods
+// starting or stopping within the range are counted correctly.
+func (c *Client) summaryNetwork(ctx context.Context, metric string, projectID int64, start, end time.Time) (float64, error) {
+	window := promDuration(end.Sub(start))
+	return c.summaryAt(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.projectSelect(objectPod, projectID, window, func(m string) string {
+			return fmt.Sprintf(`increase(%s{namespace="%s",%s}[%s])`, metric, c.Namespace, m, window)
+		}),
+	), start, end)
+}
 
-	q.Set("query", fmt.Sprintf(
+// summaryNetworkMaxMin is the former summaryNetwork computation,
+// kept to verify the billing impact of summaryNetwork.
+func (c *Client) summaryNetworkMaxMin(ctx context.Context, metric string, projectID int64, start, end time.Time) (float64, error) {
+	window := promDuration(end.Sub(start))
+	return c.summaryAt(ctx, fmt.Sprintf(
 		`(
-			  sum(max_over_time(container_network_transmit_bytes_total{namespace="%[1]s",pod=~".*-%[2]d-[^-]+-[^-]+$"}[%[3]s]))
+			  sum(%s)
 			  -
-			  sum(min_over_time(container_network_transmit_bytes_total{namespace="%[1]s",pod=~".*-%[2]d-[^-]+-[^-]+$"}[%[3]s]))
+			  sum(%s)
 		 ) or vector(0)`,
-		c.Namespace, projectID, dataRange,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
+		c.projectSelect(objectPod, projectID, window, func(m string) string {
+			return fmt.Sprintf(`max_over_time(%s{namespace="%s",%s}[%s])`, metric, c.Namespace, m, window)
+		}),
+		c.projectSelect(objectPod, projectID, window, func(m string) string {
+			return fmt.Sprintf(`min_over_time(%s{namespace="%s",%s}[%s])`, metric, c.Namespace, m, window)
+		}),
+	), start, end)
+}
 
-	return c.queryVectorValue(q)
+func (c *Client) SummaryEgress(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryNetwork(ctx, "container_network_transmit_bytes_total", projectID, start, end)
 }
 
-func (c *Client) SummaryDisk(projectID int64, startTimeUnix int64, dataRange string, rangeSecond int64) (string, error) {
-	q := make(url.Values)
+func (c *Client) SummaryIngress(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryNetwork(ctx, "container_network_receive_bytes_total", projectID, start, end)
+}
+
+func (c *Client) SummaryEgressMaxMin(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryNetworkMaxMin(ctx, "container_network_transmit_bytes_total", projectID, start, end)
+}
 
+func (c *Client) SummaryIngressMaxMin(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryNetworkMaxMin(ctx, "container_network_receive_bytes_total", projectID, start, end)
+}
+
+func (c *Client) SummaryDisk(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
 	// byte-seconds (same base as memory): reserved PVC bytes integrated over the
 	// range. The disk SKU uses unit=GiB and the frontend converts to GiB-s, exactly
 	// like memory — so no /1024³ and no /3600 here.
-	q.Set("query", fmt.Sprintf(
-		`(sum(avg_over_time(kube_persistentvolumeclaim_resource_requests_storage_bytes{namespace="%s",persistentvolumeclaim=~".*-%d$"}[%s])) or vector(0)) * %d`,
-		c.Namespace, projectID, dataRange, rangeSecond,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
-
-	return c.queryVectorValue(q)
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.projectSelect(objectVolume, projectID, "", func(m string) string {
+			return fmt.Sprintf(`kube_persistentvolumeclaim_resource_requests_storage_bytes{namespace="%s",%s}`, c.Namespace, m)
+		}),
+	), start, end, integralStep)
 }
 
-func (c *Client) SummaryEgressProcessing(projectID int64, startTimeUnix int64, dataRange string) (string, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
-		`(
-				  sum(max_over_time(parapet_backend_network_read_bytes{service_namespace="%s",service_name=~".*-%d$"}[%s]))
-				  -
-				  sum(min_over_time(parapet_backend_network_read_bytes{service_namespace="%s",service_name=~".*-%d$"}[%s]))
-				) or vector(0)`,
-		c.Namespace, projectID, dataRange,
-		c.Namespace, projectID, dataRange,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
-
-	return c.queryVectorValue(q)
+func (c *Client) SummaryEgressProcessing(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryAt(ctx, fmt.Sprintf(
+		`sum(increase(parapet_backend_network_read_bytes{service_namespace="%[1]s",service_name=~".*-%[2]d$"}[%[3]s])) or vector(0)`,
+		c.Namespace, projectID, promDuration(end.Sub(start)),
+	), start, end)
 }
 
-func (c *Client) SummaryIngressProcessing(projectID int64, startTimeUnix int64, dataRange string) (string, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
-		`(
-		  sum(max_over_time(parapet_backend_network_write_bytes{service_namespace="%s",service_name=~".*-%d$"}[%s]))
-		  -
-		  sum(min_over_time(parapet_backend_network_write_bytes{service_namespace="%s",service_name=~".*-%d$"}[%s]))
-		) or vector(0)`,
-		c.Namespace, projectID, dataRange,
-		c.Namespace, projectID, dataRange,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
-
-	return c.queryVectorValue(q)
+func (c *Client) SummaryIngressProcessing(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.summaryAt(ctx, fmt.Sprintf(
+		`sum(increase(parapet_backend_network_write_bytes{service_namespace="%[1]s",service_name=~".*-%[2]d$"}[%[3]s])) or vector(0)`,
+		c.Namespace, projectID, promDuration(end.Sub(start)),
+	), start, end)
 }
 
-func (c *Client) SummaryReplica(projectID int64, startTimeUnix int64, dataRange string, rangeSecond int64) (string, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
-		`(sum(avg_over_time(kube_deployment_status_replicas_available{namespace="%s",deployment=~".*-%d$"}[%s])) or vector(0)) * %d`,
-		c.Namespace, projectID, dataRange, rangeSecond,
-	))
-	q.Set("time", strconv.FormatInt(startTimeUnix, 10))
+// SummaryReplica returns available replica-seconds over [start, end].
+func (c *Client) SummaryReplica(ctx context.Context, projectID int64, start, end time.Time) (float64, error) {
+	return c.integral(ctx, fmt.Sprintf(
+		`sum(%s) or vector(0)`,
+		c.replicas(projectID),
+	), start, end, integralStep)
+}
 
-	return c.queryVectorValue(q)
+// SummaryReplicaByDeployment returns available replica-seconds of each
+// deployment over [start, end] with attribution labels joined,
+// the same as SummaryReplica before summing across deployments.
+func (c *Client) SummaryReplicaByDeployment(ctx context.Context, projectID int64, start, end time.Time) ([]*DeploymentVector, error) {
+	ss, err := c.integralSamples(ctx, c.withLabels(objectDeployment, "", fmt.Sprintf(
+		`sum by (namespace, deployment) (%s)`,
+		c.replicas(projectID),
+	)), start, end, integralStep)
+	if err != nil {
+		return nil, err
+	}
+	return c.deploymentVectors(ss), nil
 }
 
-func (c *Client) GetCPUUsage() ([]*PodVector, error) {
-	q := make(url.Values)
+func (c *Client) replicas(projectID int64) string {
+	return c.projectSelect(objectDeployment, projectID, "", func(m string) string {
+		return fmt.Sprintf(`kube_deployment_status_replicas_available{namespace="%s",%s}`, c.Namespace, m)
+	})
+}
 
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetCPUUsage(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`irate(container_cpu_usage_seconds_total{namespace="%s",name=""}[1m])`,
 		c.Namespace,
 	))
-
-	return c.queryPodVectors(q)
 }
 
-func (c *Client) GetCPU() ([]*PodVector, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetCPU(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`kube_pod_container_resource_requests{namespace="%s",resource="cpu"}`,
 		c.Namespace,
 	))
-
-	return c.queryPodVectors(q)
 }
 
-func (c *Client) GetCPULimit() ([]*PodVector, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetCPULimit(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`kube_pod_container_resource_limits{namespace="%s",resource="cpu"} > 0`,
 		c.Namespace,
 	))
-
-	return c.queryPodVectors(q)
 }
 
-func (c *Client) GetMemoryUsage() ([]*PodVector, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetMemoryUsage(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`container_memory_usage_bytes{namespace="%s",name=""}`,
 		c.Namespace,
 	))
-
-	return c.queryPodVectors(q)
 }
 
-func (c *Client) GetMemory() ([]*PodVector, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetMemory(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`kube_pod_container_resource_requests{namespace="%s",resource="memory"} > 0`,
 		c.Namespace,
 	))
-
-	return c.queryPodVectors(q)
 }
 
-func (c *Client) GetMemoryLimit() ([]*PodVector, error) {
-	q := make(url.Values)
-
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetMemoryLimit(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`kube_pod_container_resource_limits{namespace="%s",resource="memory"} > 0`,
 		c.Namespace,
 	))
+}
 
-	return c.queryPodVectors(q)
+// GetResourceRequests returns requests of an extended resource,
+// resource is the kubernetes resource name.
+func (c *Client) GetResourceRequests(ctx context.Context, resource string) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`kube_pod_container_resource_requests{namespace="%s",resource="%s"} > 0`,
+		c.Namespace, ResourceName(resource),
+	))
 }
 
-func (c *Client) GetEgress() ([]*PodVector, error) {
-	q := make(url.Values)
+func (c *Client) GetEphemeralStorageUsage(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`container_fs_usage_bytes{namespace="%s",container!="",container!="POD"}`,
+		c.Namespace,
+	))
+}
 
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetEgress(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
 		`rate(container_network_transmit_bytes_total{namespace="%s"}[1m])`,
 		c.Namespace,
 	))
+}
 
-	return c.queryPodVectors(q)
+func (c *Client) GetIngress(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`rate(container_network_receive_bytes_total{namespace="%s"}[1m])`,
+		c.Namespace,
+	))
 }
 
-func (c *Client) GetRequests() ([]*PodVector, error) {
-	q := make(url.Values)
+// GetCPUThrottled returns the ratio of throttled cfs periods per pod,
+// pods without cfs periods in the window, e.g. idle, are left out.
+func (c *Client) GetCPUThrottled(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`sum by (namespace, pod) (rate(container_cpu_cfs_throttled_periods_total{namespace="%[1]s",container!=""}[1m]))`+
+			` / (sum by (namespace, pod) (rate(container_cpu_cfs_periods_total{namespace="%[1]s",container!=""}[1m])) > 0)`,
+		c.Namespace,
+	))
+}
+
+// GetOOMKills returns container restarts caused by OOM kill in the last minute,
+// the interval of the deployment loop, so each kill is reported once.
+func (c *Client) GetOOMKills(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`round(increase(kube_pod_container_status_restarts_total{namespace="%[1]s"}[1m]))`+
+			` * on (namespace, pod, container) group_left () (kube_pod_container_status_last_terminated_reason{namespace="%[1]s",reason="OOMKilled"} > 0)`,
+		c.Namespace,
+	))
+}
+
+// GetRestarts returns container restarts in the last minute,
+// the interval of the deployment loop, so each restart is reported once.
+func (c *Client) GetRestarts(ctx context.Context) ([]*PodVector, error) {
+	return c.queryPodVectors(ctx, fmt.Sprintf(
+		`round(increase(kube_pod_container_status_restarts_total{namespace="%s"}[1m]))`,
+		c.Namespace,
+	))
+}
 
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetRequests(ctx context.Context) ([]*PodVector, error) {
+	return c.queryServiceVectors(ctx, fmt.Sprintf(
 		`sum(rate(parapet_requests{ingress_namespace="%s"}[1m])) by (service_name)`,
 		c.Namespace,
 	))
+}
 
-	return c.queryPodVectors(q)
+// getRequestsStatus returns request rate of a status class, e.g. "5" for 5xx.
+func (c *Client) getRequestsStatus(ctx context.Context, class string) ([]*PodVector, error) {
+	return c.queryServiceVectors(ctx, fmt.Sprintf(
+		`sum(rate(parapet_requests{ingress_namespace="%s",status=~"%s.."}[1m])) by (service_name)`,
+		c.Namespace, class,
+	))
 }
 
-func (c *Client) GetDiskUsage() ([]*VolumeVector, error) {
-	q := make(url.Values)
+func (c *Client) GetRequests2xx(ctx context.Context) ([]*PodVector, error) {
+	return c.getRequestsStatus(ctx, "2")
+}
 
-	q.Set("query", fmt.Sprintf(
-		`kubelet_volume_stats_used_bytes{namespace="%s"}`,
-		c.Namespace,
+func (c *Client) GetRequests4xx(ctx context.Context) ([]*PodVector, error) {
+	return c.getRequestsStatus(ctx, "4")
+}
+
+func (c *Client) GetRequests5xx(ctx context.Context) ([]*PodVector, error) {
+	return c.getRequestsStatus(ctx, "5")
+}
+
+// getLatency returns the q-quantile of request duration in seconds.
+// Services without requests in the window have a NaN quantile,
+// they are left out in the query instead of dropped as non-finite.
+func (c *Client) getLatency(ctx context.Context, q float64) ([]*PodVector, error) {
+	return c.queryServiceVectors(ctx, fmt.Sprintf(
+		`histogram_quantile(%[1]s, sum(rate(%[2]s_bucket{ingress_namespace="%[3]s"}[1m])) by (service_name, le))`+
+			` and on (service_name) sum(rate(%[2]s_count{ingress_namespace="%[3]s"}[1m])) by (service_name) > 0`,
+		strconv.FormatFloat(q, 'f', -1, 64), c.latencyMetric(), c.Namespace,
 	))
+}
 
-	return c.queryVolumeVectors(q)
+func (c *Client) GetLatencyP95(ctx context.Context) ([]*PodVector, error) {
+	return c.getLatency(ctx, 0.95)
 }
 
-func (c *Client) GetDiskSize() ([]*VolumeVector, error) {
-	q := make(url.Values)
+func (c *Client) GetLatencyP99(ctx context.Context) ([]*PodVector, error) {
+	return c.getLatency(ctx, 0.99)
+}
 
-	q.Set("query", fmt.Sprintf(
+func (c *Client) GetDiskUsage(ctx context.Context) ([]*VolumeVector, error) {
+	return c.queryVolumeVectors(ctx, fmt.Sprintf(
+		`kubelet_volume_stats_used_bytes{namespace="%s"}`,
+		c.Namespace,
+	))
+}
+
+func (c *Client) GetDiskSize(ctx context.Context) ([]*VolumeVector, error) {
+	return c.queryVolumeVectors(ctx, fmt.Sprintf(
 		`kube_persistentvolumeclaim_resource_requests_storage_bytes{namespace="%s"}`,
 		c.Namespace,
 	))
+}
+
+func (c *Client) getDiskRate(ctx context.Context, metric string) ([]*VolumeVector, error) {
+	if metric == "" {
+		return nil, nil
+	}
+	return c.queryVolumeVectors(ctx, fmt.Sprintf(
+		`sum by (namespace, persistentvolumeclaim) (rate(%s{namespace="%s"}[1m]))`,
+		metric, c.Namespace,
+	))
+}
+
+func (c *Client) GetDiskReadIOPS(ctx context.Context) ([]*VolumeVector, error) {
+	return c.getDiskRate(ctx, c.DiskIOMetrics.ReadOps)
+}
 
-	return c.queryVolumeVectors(q)
+func (c *Client) GetDiskWriteIOPS(ctx context.Context) ([]*VolumeVector, error) {
+	return c.getDiskRate(ctx, c.DiskIOMetrics.WriteOps)
+}
+
+func (c *Client) GetDiskReadThroughput(ctx context.Context) ([]*VolumeVector, error) {
+	return c.getDiskRate(ctx, c.DiskIOMetrics.ReadBytes)
+}
+
+func (c *Client) GetDiskWriteThroughput(ctx context.Context) ([]*VolumeVector, error) {
+	return c.getDiskRate(ctx, c.DiskIOMetrics.WriteBytes)
+}
+
+// GetSnapshotSize returns volume snapshot bytes per source volume.
+func (c *Client) GetSnapshotSize(ctx context.Context) ([]*VolumeVector, error) {
+	if c.SnapshotMetric == "" {
+		return nil, nil
+	}
+	return c.queryVolumeVectors(ctx, fmt.Sprintf(
+		`sum by (namespace, persistentvolumeclaim) (%s)`,
+		c.snapshotSize(""),
+	))
 }
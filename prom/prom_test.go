@@ -0,0 +1,204 @@
+package prom
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSeries is a fixed result series of a test prometheus.
+type testSeries struct {
+	Labels map[string]string
+	Values []float64 // one value per step from start
+}
+
+// testServer returns a prometheus stand-in answering every query with
+// the series f returns for it, as a matrix for range queries from the
+// query start at its step, or as a vector of the last values.
+func testServer(t *testing.T, f func(query string) []testSeries) *Client {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		ss := f(q.Get("query"))
+
+		type result struct {
+			Metric map[string]string `json:"metric"`
+			Value  []any             `json:"value,omitempty"`
+			Values [][]any           `json:"values,omitempty"`
+		}
+		var resp struct {
+			Status string `json:"status"`
+			Data   struct {
+				ResultType string   `json:"resultType"`
+				Result     []result `json:"result"`
+			} `json:"data"`
+		}
+		resp.Status = "success"
+		resp.Data.Result = []result{}
+
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			resp.Data.ResultType = "matrix"
+			start, _ := strconv.ParseFloat(q.Get("start"), 64)
+			step, _ := strconv.ParseFloat(q.Get("step"), 64)
+			for _, s := range ss {
+				x := result{Metric: s.Labels}
+				for i, v := range s.Values {
+					if math.IsNaN(v) {
+						continue
+					}
+					x.Values = append(x.Values, []any{start + float64(i)*step, strconv.FormatFloat(v, 'f', -1, 64)})
+				}
+				resp.Data.Result = append(resp.Data.Result, x)
+			}
+		case "/api/v1/query":
+			resp.Data.ResultType = "vector"
+			at, _ := strconv.ParseFloat(q.Get("time"), 64)
+			if at == 0 {
+				at = float64(time.Now().Unix())
+			}
+			for _, s := range ss {
+				v := s.Values[len(s.Values)-1]
+				resp.Data.Result = append(resp.Data.Result, result{
+					Metric: s.Labels,
+					Value:  []any{at, strconv.FormatFloat(v, 'f', -1, 64)},
+				})
+			}
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	return &Client{
+		Endpoint:  srv.URL,
+		Namespace: "ns",
+		Step:      time.Minute,
+	}
+}
+
+func TestSummaryCPUOverage(t *testing.T) {
+	pod := func(name string) map[string]string {
+		return map[string]string{"pod": name}
+	}
+
+	c := testServer(t, func(query string) []testSeries {
+		switch {
+		case strings.Contains(query, "container_cpu_usage_seconds_total"):
+			return []testSeries{
+				{pod("idle-1-7d9f8b6c4-x7k2p"), []float64{0.1, 0.1, 0.1, 0.1}},
+				{pod("burst-1-7d9f8b6c4-x7k2p"), []float64{0.5, 2, 2, 0.5}},
+				{pod("batch-1-x7k2p"), []float64{0.2, 0.2, 0.2, 0.2}},
+			}
+		case strings.Contains(query, "kube_pod_container_resource_requests"):
+			return []testSeries{
+				{pod("idle-1-7d9f8b6c4-x7k2p"), []float64{1, 1, 1, 1}},
+				{pod("burst-1-7d9f8b6c4-x7k2p"), []float64{0.5, 0.5, 0.5, 0.5}},
+			}
+		}
+		t.Errorf("unexpected query %s", query)
+		return nil
+	})
+
+	start := time.Unix(1800000000, 0)
+	end := start.Add(3 * time.Minute)
+	got, err := c.SummaryCPUOverage(t.Context(), 1, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// idle: never above requests, 0
+	// burst: 0, 1.5, 1.5, 0 => 45 + 90 + 45 = 180,
+	//   not offset by the idle requests of the other pod
+	// batch: no requests, 0.2 * 180 = 36
+	const want = 216
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSummaryCPUOverageGap(t *testing.T) {
+	c := testServer(t, func(query string) []testSeries {
+		if strings.Contains(query, "kube_pod_container_resource_requests") {
+			return nil
+		}
+		// the pod is gone between the 2 points, nothing is integrated across the gap
+		return []testSeries{
+			{map[string]string{"pod": "web-1-7d9f8b6c4-x7k2p"}, []float64{1, 1, math.NaN(), 1}},
+		}
+	})
+
+	start := time.Unix(1800000000, 0)
+	got, err := c.SummaryCPUOverage(t.Context(), 1, start, start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 60 {
+		t.Errorf("got %v, want 60", got)
+	}
+}
+
+func TestSummaryCPUOverageEmptyRange(t *testing.T) {
+	c := testServer(t, func(query string) []testSeries {
+		t.Errorf("unexpected query %s", query)
+		return nil
+	})
+
+	start := time.Unix(1800000000, 0)
+	got, err := c.SummaryCPUOverage(t.Context(), 1, start, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
+
+func TestSummaryReplicaByDeployment(t *testing.T) {
+	c := testServer(t, func(query string) []testSeries {
+		if !strings.Contains(query, "kube_deployment_status_replicas_available") {
+			t.Errorf("unexpected query %s", query)
+			return nil
+		}
+		if !strings.Contains(query, "sum by (namespace, deployment)") {
+			t.Errorf("query %s is not summed by deployment", query)
+		}
+		return []testSeries{
+			{map[string]string{"namespace": "ns", "deployment": "web-1", "label_deploys_app_project": "1", "label_deploys_app_name": "web"}, []float64{2, 2, 2, 2}},
+			{map[string]string{"namespace": "ns", "deployment": "api-1"}, []float64{1, 1, math.NaN(), math.NaN()}},
+			{map[string]string{"namespace": "ns"}, []float64{1, 1, 1, 1}},
+		}
+	})
+	c.ProjectLabel = "deploys.app/project"
+	c.NameLabel = "deploys.app/name"
+
+	start := time.Unix(1800000000, 0)
+	end := start.Add(3 * time.Minute)
+	got, err := c.SummaryReplicaByDeployment(t.Context(), 1, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]DeploymentVector{
+		"web-1": {Deployment: "web-1", Project: "1", Name: "web", Value: 360},
+		"api-1": {Deployment: "api-1", Value: 120},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d vectors, want %d", len(got), len(want))
+	}
+	for _, v := range got {
+		w := want[v.Deployment]
+		if v.Project != w.Project || v.Name != w.Name || math.Abs(v.Value-w.Value) > 1e-9 {
+			t.Errorf("%s: got project %q, name %q, value %v, want %q, %q, %v", v.Deployment, v.Project, v.Name, v.Value, w.Project, w.Name, w.Value)
+		}
+	}
+}
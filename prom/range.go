@@ -0,0 +1,182 @@
+package prom
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Point is a single value of a range query series.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// Series is a range query result with its full label set.
+type Series struct {
+	Labels map[string]string
+	Points []Point
+}
+
+// Label returns the value of label name, or empty string if not set.
+func (s *Series) Label(name string) string {
+	return s.Labels[name]
+}
+
+// IntegrateStep integrates s as a step function, each point holds its value
+// until the next point but not longer than step, and never past end.
+func (s *Series) IntegrateStep(step time.Duration, end time.Time) float64 {
+	var r float64
+	for i, p := range s.Points {
+		d := step
+		if i+1 < len(s.Points) {
+			if n := s.Points[i+1].Time.Sub(p.Time); n < d {
+				d = n
+			}
+		}
+		if n := end.Sub(p.Time); n < d {
+			d = n
+		}
+		if d <= 0 {
+			continue
+		}
+		r += p.Value * d.Seconds()
+	}
+	return r
+}
+
+// IntegrateTrapezoid integrates s using the trapezoidal rule between
+// consecutive points. Points more than step apart are treated as a gap
+// and contribute nothing in between.
+func (s *Series) IntegrateTrapezoid(step time.Duration) float64 {
+	var r float64
+	for i := 1; i < len(s.Points); i++ {
+		a, b := s.Points[i-1], s.Points[i]
+		d := b.Time.Sub(a.Time)
+		if d <= 0 || d > step {
+			continue
+		}
+		r += (a.Value + b.Value) / 2 * d.Seconds()
+	}
+	return r
+}
+
+// QueryRange runs a range query and returns every series in the result.
+// Points with non-finite values are dropped and reported to OnNonFinite.
+func (c *Client) QueryRange(ctx context.Context, query string, start, end time.Time, step time.Duration) ([]*Series, error) {
+	q := make(url.Values)
+	q.Set("query", query)
+	q.Set("start", strconv.FormatInt(start.Unix(), 10))
+	q.Set("end", strconv.FormatInt(end.Unix(), 10))
+	q.Set("step", strconv.FormatFloat(step.Seconds(), 'f', -1, 64))
+
+	resp, err := c.do(ctx, "/api/v1/query_range?"+q.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var p struct {
+		Status string
+		Data   struct {
+			ResultType string
+			Result     []struct {
+				Metric map[string]string
+				Values [][]any
+			}
+		}
+	}
+	err = json.Unmarshal(resp, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Status != "success" {
+		return nil, fmt.Errorf("status not success")
+	}
+
+	var dropped int
+	defer func() { c.nonFinite(query, dropped) }()
+
+	ss := make([]*Series, 0, len(p.Data.Result))
+	for _, x := range p.Data.Result {
+		s := Series{
+			Labels: x.Metric,
+			Points: make([]Point, 0, len(x.Values)),
+		}
+		for _, v := range x.Values {
+			t, f, err := parseSample(v)
+			if errors.Is(err, ErrNonFiniteValue) {
+				dropped++
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			s.Points = append(s.Points, Point{Time: t, Value: f})
+		}
+		ss = append(ss, &s)
+	}
+
+	return ss, nil
+}
+
+type integralMode int
+
+const (
+	integralStep integralMode = iota
+	integralTrapezoid
+)
+
+// integralSamples evaluates query over [start, end] and returns the integral
+// of each result series, in value-seconds, as a sample at end.
+func (c *Client) integralSamples(ctx context.Context, query string, start, end time.Time, mode integralMode) ([]*Sample, error) {
+	if !end.After(start) {
+		return nil, nil
+	}
+
+	step := c.step()
+	ss, err := c.QueryRange(ctx, query, start, end, step)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := make([]*Sample, 0, len(ss))
+	for _, s := range ss {
+		var v float64
+		switch mode {
+		case integralStep:
+			v = s.IntegrateStep(step, end)
+		case integralTrapezoid:
+			v = s.IntegrateTrapezoid(step)
+		}
+		rs = append(rs, &Sample{
+			Labels: s.Labels,
+			Time:   end,
+			Value:  v,
+		})
+	}
+	return rs, nil
+}
+
+// integral evaluates query over [start, end] and returns the sum of the
+// integrals of all result series, in value-seconds.
+func (c *Client) integral(ctx context.Context, query string, start, end time.Time, mode integralMode) (float64, error) {
+	ss, err := c.integralSamples(ctx, query, start, end, mode)
+	if err != nil {
+		return 0, err
+	}
+
+	var r float64
+	for _, s := range ss {
+		r += s.Value
+	}
+	return r, nil
+}
+
+// promDuration formats d as a prometheus range duration.
+func promDuration(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
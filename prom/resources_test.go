@@ -0,0 +1,102 @@
+package prom
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var reResourceMatcher = regexp.MustCompile(`resource="([^"]*)"`)
+
+// resourceRequestsServer serves the recorded kube-state-metrics requests,
+// selected by the resource matcher of the query.
+func resourceRequestsServer(t *testing.T) *Client {
+	t.Helper()
+
+	b, err := os.ReadFile("testdata/kube_pod_container_resource_requests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixture []testSeries
+	err = json.Unmarshal(b, &fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testServer(t, func(query string) []testSeries {
+		m := reResourceMatcher.FindStringSubmatch(query)
+		if m == nil {
+			t.Errorf("query without resource matcher: %s", query)
+			return nil
+		}
+		var ss []testSeries
+		for _, s := range fixture {
+			if s.Labels["resource"] == m[1] {
+				ss = append(ss, s)
+			}
+		}
+		return ss
+	})
+}
+
+func TestResourceName(t *testing.T) {
+	cases := map[string]string{
+		"nvidia.com/gpu":        "nvidia_com_gpu",
+		"amd.com/gpu":           "amd_com_gpu",
+		"example.com/foo-bar":   "example_com_foo_bar",
+		"hugepages-2Mi":         "hugepages_2Mi",
+		"already_sanitized_123": "already_sanitized_123",
+	}
+	for in, want := range cases {
+		if got := ResourceName(in); got != want {
+			t.Errorf("ResourceName(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestGetResourceRequests(t *testing.T) {
+	c := resourceRequestsServer(t)
+
+	vs, err := c.GetResourceRequests(t.Context(), "nvidia.com/gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]float64)
+	for _, v := range vs {
+		if r := v.Labels["resource"]; r != "nvidia_com_gpu" {
+			t.Errorf("pod %s has resource %s", v.Pod, r)
+		}
+		got[v.Pod+"/"+v.Container] = v.Value
+	}
+	want := map[string]float64{
+		"train-1-7d9f8b6c4-x7k2p/train": 1,
+		"infer-1-5c8d94-b2n4m/infer":    2,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestSummaryResourceRequests(t *testing.T) {
+	c := resourceRequestsServer(t)
+
+	start := time.Unix(1800000000, 0)
+	got, err := c.SummaryResourceRequests(t.Context(), "nvidia.com/gpu", 1, start, start.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 gpus for 4 steps of 60 seconds
+	const want = 720
+	if got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
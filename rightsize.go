@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deploys-app/api"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/deploys-app/collector/prom"
+)
+
+const (
+	minCPURecommendation    = 0.01    // cores
+	minMemoryRecommendation = 1 << 24 // bytes
+
+	memoryRecommendationUnit = 1 << 20 // bytes
+)
+
+// recommendation is the suggested requests and limits of a deployment,
+// values are per pod, cpu in cores and memory in bytes.
+type recommendation struct {
+	ProjectID int64  `json:"projectId"`
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+
+	CPUUsage          float64 `json:"cpuUsage"` // quantile
+	CPUPeak           float64 `json:"cpuPeak"`
+	CPU               float64 `json:"cpu"`
+	CPULimit          float64 `json:"cpuLimit"`
+	SuggestedCPU      float64 `json:"suggestedCpu"`
+	SuggestedCPULimit float64 `json:"suggestedCpuLimit"`
+
+	MemoryUsage          float64 `json:"memoryUsage"` // quantile
+	MemoryPeak           float64 `json:"memoryPeak"`
+	Memory               float64 `json:"memory"`
+	MemoryLimit          float64 `json:"memoryLimit"`
+	SuggestedMemory      float64 `json:"suggestedMemory"`
+	SuggestedMemoryLimit float64 `json:"suggestedMemoryLimit"`
+}
+
+// rightsizeOptions controls how recommendations are computed.
+type rightsizeOptions struct {
+	Quantile float64 // usage quantile the requests are sized for
+	Headroom float64 // fraction added on top of the usage
+}
+
+// recommend returns usage with headroom,
+// rounded up to unit and never below floor.
+// Units are rounded to 1e-6 first, so float error, e.g. 0.1 * 1.1 / 0.001
+// = 110.00000000000001, does not round up a whole unit.
+func recommend(usage, headroom, unit, floor float64) float64 {
+	n := math.Round(usage*(1+headroom)/unit*1e6) / 1e6
+	return max(math.Ceil(n)*unit, floor)
+}
+
+// recommendations computes the requests and limits of every deployment
+// from the pod usage over [start, end].
+// Requests are sized for the usage quantile, limits for the peak usage,
+// both with headroom.
+func (w *Worker) recommendations(ctx context.Context, start, end time.Time, step time.Duration, opt rightsizeOptions) ([]*recommendation, error) {
+	type history struct {
+		F  func(context.Context, time.Time, time.Time, time.Duration) ([]*prom.PodSeries, error)
+		ss []*prom.PodSeries
+	}
+	var (
+		cpuUsage    = history{F: w.PromClient.HistoryCPUUsage}
+		cpu         = history{F: w.PromClient.HistoryCPU}
+		cpuLimit    = history{F: w.PromClient.HistoryCPULimit}
+		memoryUsage = history{F: w.PromClient.HistoryMemoryUsage}
+		memory      = history{F: w.PromClient.HistoryMemory}
+		memoryLimit = history{F: w.PromClient.HistoryMemoryLimit}
+	)
+
+	g, gctx := errgroup.WithContext(ctx)
+	for _, h := range []*history{&cpuUsage, &cpu, &cpuLimit, &memoryUsage, &memory, &memoryLimit} {
+		g.Go(func() error {
+			var err error
+			h.ss, err = h.F(gctx, start, end, step)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	projects := w.activeProjects(ctx)
+	group := func(h history) map[workload]*workloadSeries {
+		return groupWorkloads(h.ss, projects)
+	}
+	cpuUsages := group(cpuUsage)
+	cpuRequests := group(cpu)
+	cpuLimits := group(cpuLimit)
+	memoryUsages := group(memoryUsage)
+	memoryRequests := group(memory)
+	memoryLimits := group(memoryLimit)
+
+	latest := func(m map[workload]*workloadSeries, k workload) float64 {
+		if x := m[k]; x != nil {
+			return x.Latest()
+		}
+		return 0
+	}
+
+	var rs []*recommendation
+	for _, k := range sortedWorkloads(cpuUsages) {
+		x := cpuUsages[k]
+		mx := memoryUsages[k]
+		if mx == nil {
+			continue
+		}
+
+		cpuValues, memoryValues := x.Values(), mx.Values()
+		r := recommendation{
+			ProjectID: k.ProjectID,
+			Name:      k.Name,
+			Kind:      x.Kind,
+
+			CPUUsage:    quantile(cpuValues, opt.Quantile),
+			CPUPeak:     quantile(cpuValues, 1),
+			CPU:         latest(cpuRequests, k),
+			CPULimit:    latest(cpuLimits, k),
+			MemoryUsage: quantile(memoryValues, opt.Quantile),
+			MemoryPeak:  quantile(memoryValues, 1),
+			Memory:      latest(memoryRequests, k),
+			MemoryLimit: latest(memoryLimits, k),
+		}
+		r.SuggestedCPU = recommend(r.CPUUsage, opt.Headroom, 0.001, minCPURecommendation)
+		r.SuggestedCPULimit = recommend(r.CPUPeak, opt.Headroom, 0.001, r.SuggestedCPU)
+		r.SuggestedMemory = recommend(r.MemoryUsage, opt.Headroom, memoryRecommendationUnit, minMemoryRecommendation)
+		r.SuggestedMemoryLimit = recommend(r.MemoryPeak, opt.Headroom, memoryRecommendationUnit, r.SuggestedMemory)
+		rs = append(rs, &r)
+	}
+	return rs, nil
+}
+
+// submitRecommendations sends recommendations as deployment usage,
+// reported on a pod named after the deployment.
+func (w *Worker) submitRecommendations(ctx context.Context, rs []*recommendation, at time.Time) error {
+	req := api.CollectorSetDeploymentUsage{
+		Location: w.Location,
+	}
+	for _, r := range rs {
+		for _, x := range []struct {
+			Name  string
+			Value float64
+		}{
+			{"cpu_recommendation", r.SuggestedCPU},
+			{"cpu_limit_recommendation", r.SuggestedCPULimit},
+			{"memory_recommendation", r.SuggestedMemory},
+			{"memory_limit_recommendation", r.SuggestedMemoryLimit},
+		} {
+			req.List = append(req.List, &api.CollectorDeploymentUsageItem{
+				ProjectID:      r.ProjectID,
+				DeploymentName: r.Name,
+				Pod:            r.Name,
+				Name:           x.Name,
+				Value:          x.Value,
+				At:             at.Unix(),
+			})
+		}
+	}
+	if len(req.List) == 0 {
+		return nil
+	}
+
+	_, err := w.Client.Collector().SetDeploymentUsage(ctx, &req)
+	return err
+}
+
+func runRightsize(ctx context.Context, w *Worker, args []string) error {
+	var (
+		h   historyFlags
+		opt rightsizeOptions
+	)
+	fs := flag.NewFlagSet("rightsize", flag.ExitOnError)
+	h.register(fs, 7*24*time.Hour)
+	fs.Float64Var(&opt.Quantile, "quantile", 0.95, "usage quantile to size requests for")
+	fs.Float64Var(&opt.Headroom, "headroom", 0.2, "fraction added on top of the usage")
+	submit := fs.Bool("submit", false, "submit recommendations to the api")
+	fs.Parse(args)
+
+	if opt.Quantile <= 0 || opt.Quantile > 1 {
+		return fmt.Errorf("invalid quantile %v", opt.Quantile)
+	}
+	if opt.Headroom < 0 {
+		return fmt.Errorf("invalid headroom %v", opt.Headroom)
+	}
+
+	start, end := h.Range()
+	rs, err := w.recommendations(ctx, start, end, h.Step, opt)
+	if err != nil {
+		return err
+	}
+
+	if *submit {
+		err = w.submitRecommendations(ctx, rs, end)
+		if err != nil {
+			return err
+		}
+		slog.Info("collector: submitted recommendations", "deployments", len(rs))
+	}
+
+	if h.JSON {
+		return json.NewEncoder(os.Stdout).Encode(rs)
+	}
+
+	cpu := func(v float64) string {
+		return strconv.FormatFloat(v*1000, 'f', 0, 64) + "m"
+	}
+	memory := func(v float64) string {
+		return strconv.FormatFloat(v/memoryRecommendationUnit, 'f', 0, 64) + "Mi"
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "recommendations from %s to %s, p%s usage with %s%% headroom\n",
+		start.Format(time.RFC3339), end.Format(time.RFC3339),
+		strconv.FormatFloat(opt.Quantile*100, 'f', -1, 64),
+		strconv.FormatFloat(opt.Headroom*100, 'f', -1, 64),
+	)
+	fmt.Fprintln(tw, "PROJECT\tDEPLOYMENT\tKIND\tCPU USAGE\tCPU PEAK\tCPU\t->\tCPU LIMIT\t->\tMEMORY USAGE\tMEMORY PEAK\tMEMORY\t->\tMEMORY LIMIT\t->")
+	for _, r := range rs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.ProjectID, r.Name, r.Kind,
+			cpu(r.CPUUsage), cpu(r.CPUPeak), cpu(r.CPU), cpu(r.SuggestedCPU), cpu(r.CPULimit), cpu(r.SuggestedCPULimit),
+			memory(r.MemoryUsage), memory(r.MemoryPeak), memory(r.Memory), memory(r.SuggestedMemory), memory(r.MemoryLimit), memory(r.SuggestedMemoryLimit),
+		)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRecommend(t *testing.T) {
+	cases := []struct {
+		Name     string
+		Usage    float64
+		Headroom float64
+		Unit     float64
+		Floor    float64
+		Want     float64
+	}{
+		{"exact", 0.3, 0.2, 0.001, 0.01, 0.36},
+		{"round up", 0.1234, 0.2, 0.001, 0.01, 0.149},
+		{"float error", 0.1, 0.1, 0.001, 0.01, 0.11},
+		{"no headroom", 0.7, 0, 0.001, 0.01, 0.7},
+		{"floor", 0.001, 0.2, 0.001, 0.01, 0.01},
+		{"no usage", 0, 0.2, 0.001, 0.01, 0.01},
+		{"memory unit", 100 << 20, 0.2, 1 << 20, 1 << 24, 120 << 20},
+		{"memory round up", 100<<20 + 1, 0, 1 << 20, 1 << 24, 101 << 20},
+		{"memory floor", 1 << 20, 0.2, 1 << 20, 1 << 24, 1 << 24},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			got := recommend(c.Usage, c.Headroom, c.Unit, c.Floor)
+			if math.Abs(got-c.Want) > 1e-9 {
+				t.Errorf("recommend(%v, %v, %v, %v) = %v, want %v", c.Usage, c.Headroom, c.Unit, c.Floor, got, c.Want)
+			}
+		})
+	}
+}
+
+func TestRecommendLimit(t *testing.T) {
+	// limits are floored at the suggested request
+	cases := []struct {
+		Usage float64
+		Peak  float64
+	}{
+		{0.2, 0.5},
+		{0.2, 0.2},
+		{0.5, 0.2},
+		{0, 0},
+	}
+
+	for _, c := range cases {
+		request := recommend(c.Usage, 0.2, 0.001, minCPURecommendation)
+		limit := recommend(c.Peak, 0.2, 0.001, request)
+		if limit < request {
+			t.Errorf("usage %v, peak %v: limit %v is below request %v", c.Usage, c.Peak, limit, request)
+		}
+	}
+}